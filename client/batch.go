@@ -0,0 +1,136 @@
+package krpcc
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync"
+
+	"github.com/google/uuid"
+	"github.com/pkg/errors"
+
+	types "github.com/kooksee/krpc/types"
+)
+
+// BatchCall is a single call queued in a JSONRPCBatch. Once the batch is sent,
+// Error holds the error of this call, if any, and Result is populated
+// otherwise.
+type BatchCall struct {
+	Method string
+	Params map[string]interface{}
+	Result interface{}
+	Error  error
+
+	request types.RPCRequest
+}
+
+// JSONRPCBatch queues calls to be sent as a single JSON-RPC batch request.
+// It is Goroutine-safe.
+type JSONRPCBatch struct {
+	client *JSONRPCClient
+
+	mtx   sync.Mutex
+	calls []*BatchCall
+}
+
+// Call queues a call of method. The response is unmarshalled into result when
+// the batch is sent.
+func (b *JSONRPCBatch) Call(method string, params map[string]interface{}, result interface{}) (*BatchCall, error) {
+	request, err := types.MapToRequest(b.client.cdc, types.StringID(uuid.New().String()), method, params)
+	if err != nil {
+		return nil, err
+	}
+	call := &BatchCall{Method: method, Params: params, Result: result, request: request}
+
+	b.mtx.Lock()
+	b.calls = append(b.calls, call)
+	b.mtx.Unlock()
+	return call, nil
+}
+
+// Count returns the number of queued calls.
+func (b *JSONRPCBatch) Count() int {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	return len(b.calls)
+}
+
+// Clear removes all queued calls and returns how many there were.
+func (b *JSONRPCBatch) Clear() int {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	n := len(b.calls)
+	b.calls = nil
+	return n
+}
+
+// Send sends all queued calls in a single request and clears the batch. The
+// returned error concerns the whole batch (e.g. the server could not be
+// reached); errors of single calls are set on their BatchCall. The request is
+// intercepted by the interceptors of the client, see CallInfo.Batch.
+func (b *JSONRPCBatch) Send() ([]*BatchCall, error) {
+	return b.SendContext(context.Background())
+}
+
+// SendContext is like Send, but the request is aborted when ctx is done.
+func (b *JSONRPCBatch) SendContext(ctx context.Context) ([]*BatchCall, error) {
+	b.mtx.Lock()
+	calls := b.calls
+	b.calls = nil
+	b.mtx.Unlock()
+
+	if len(calls) == 0 {
+		return calls, nil
+	}
+
+	info := &CallInfo{Header: make(http.Header), Batch: calls}
+	return calls, intercept(ctx, b.client.interceptor, info, b.send)
+}
+
+// send sends the calls of info.Batch, setting their results or errors.
+func (b *JSONRPCBatch) send(ctx context.Context, info *CallInfo) error {
+	calls := info.Batch
+	requests := make([]types.RPCRequest, len(calls))
+	for i, call := range calls {
+		requests[i] = call.request
+	}
+	requestBytes, err := json.Marshal(requests)
+	if err != nil {
+		return err
+	}
+	responseBytes, err := b.client.post(ctx, requestBytes, info.Header)
+	if err != nil {
+		return err
+	}
+
+	// The server answers with a single response if it rejects the batch as a whole.
+	if trimmed := bytes.TrimLeft(responseBytes, " \t\r\n"); len(trimmed) > 0 && trimmed[0] == '{' {
+		response := &types.RPCResponse{}
+		if err := json.Unmarshal(responseBytes, response); err != nil {
+			return errors.Errorf("Error unmarshalling rpc response: %v", err)
+		}
+		if response.Error != nil {
+			return response.Error
+		}
+		return errors.New("Expected an array of responses")
+	}
+
+	var responses []types.RPCResponse
+	if err := json.Unmarshal(responseBytes, &responses); err != nil {
+		return errors.Errorf("Error unmarshalling rpc responses: %v", err)
+	}
+	byID := make(map[types.JSONRPCID]*types.RPCResponse, len(responses))
+	for i := range responses {
+		byID[responses[i].ID] = &responses[i]
+	}
+	for _, call := range calls {
+		response, ok := byID[call.request.ID]
+		if !ok {
+			call.Error = errors.Errorf("No response for request %v", call.request)
+			continue
+		}
+		call.Error = unmarshalResponse(b.client.cdc, response, call.Result)
+	}
+	return nil
+}
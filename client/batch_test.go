@@ -0,0 +1,131 @@
+package krpcc
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tendermint/go-amino"
+
+	krpcs "github.com/kooksee/krpc/server"
+)
+
+func newHTTPServer() *httptest.Server {
+	return newHTTPServerWith(nil)
+}
+
+func newHTTPServerWith(extra map[string]*krpcs.RPCFunc) *httptest.Server {
+	funcMap := map[string]*krpcs.RPCFunc{
+		"echo": krpcs.NewRPCFunc(func(s string) (*resultEcho, error) { return &resultEcho{s}, nil }, "arg"),
+		"fail": krpcs.NewRPCFunc(func() (*resultEcho, error) { return nil, errors.New("failed") }, ""),
+	}
+	for name, f := range extra {
+		funcMap[name] = f
+	}
+	mux := http.NewServeMux()
+	krpcs.RegisterRPCFuncs(mux, funcMap, amino.NewCodec())
+	return httptest.NewServer(mux)
+}
+
+func TestJSONRPCBatch(t *testing.T) {
+	s := newHTTPServer()
+	defer s.Close()
+	c := NewJSONRPCClient("tcp://" + s.Listener.Addr().String())
+
+	batch := c.NewBatch()
+	r1, r2 := new(resultEcho), new(resultEcho)
+	_, err := batch.Call("echo", map[string]interface{}{"arg": "one"}, r1)
+	require.NoError(t, err)
+	_, err = batch.Call("fail", map[string]interface{}{}, new(resultEcho))
+	require.NoError(t, err)
+	_, err = batch.Call("echo", map[string]interface{}{"arg": "two"}, r2)
+	require.NoError(t, err)
+	assert.Equal(t, 3, batch.Count())
+
+	calls, err := batch.Send()
+	require.NoError(t, err)
+	require.Len(t, calls, 3)
+	assert.Equal(t, 0, batch.Count(), "Send clears the batch")
+
+	assert.NoError(t, calls[0].Error)
+	assert.Equal(t, "one", r1.Value)
+	if assert.Error(t, calls[1].Error) {
+		assert.Contains(t, calls[1].Error.Error(), "failed")
+	}
+	assert.NoError(t, calls[2].Error)
+	assert.Equal(t, "two", r2.Value)
+}
+
+func TestJSONRPCBatchRejected(t *testing.T) {
+	s := newHTTPServer()
+	defer s.Close()
+	c := NewJSONRPCClient("tcp://" + s.Listener.Addr().String())
+
+	batch := c.NewBatch()
+	for i := 0; i < krpcs.DefaultConfig().MaxBatchSize+1; i++ {
+		_, err := batch.Call("echo", map[string]interface{}{"arg": "x"}, new(resultEcho))
+		require.NoError(t, err)
+	}
+	_, err := batch.Send()
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "Invalid Request")
+}
+
+func TestJSONRPCBatchSendContext(t *testing.T) {
+	release := make(chan struct{})
+	s := newHTTPServerWith(map[string]*krpcs.RPCFunc{
+		"slow": krpcs.NewRPCFunc(func() (*resultEcho, error) { <-release; return &resultEcho{}, nil }, ""),
+	})
+	defer s.Close()
+	// unblock the slow handlers before the server waits for them
+	defer close(release)
+	c := NewJSONRPCClient("tcp://" + s.Listener.Addr().String())
+
+	batch := c.NewBatch()
+	_, err := batch.Call("slow", map[string]interface{}{}, new(resultEcho))
+	require.NoError(t, err)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	calls, err := batch.SendContext(ctx)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "context deadline exceeded")
+	assert.Len(t, calls, 1)
+}
+
+func TestJSONRPCBatchInterceptors(t *testing.T) {
+	inner := newHTTPServer()
+	defer inner.Close()
+	h := inner.Config.Handler
+	// the server requires authorization
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer token" {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		h.ServeHTTP(w, r)
+	}))
+	defer s.Close()
+
+	var batches [][]*BatchCall
+	auth := func(ctx context.Context, info *CallInfo, next Invoker) error {
+		batches = append(batches, info.Batch)
+		info.Header.Set("Authorization", "Bearer token")
+		return next(ctx, info)
+	}
+	c := NewJSONRPCClient("tcp://"+s.Listener.Addr().String(), WithInterceptors(auth))
+
+	batch := c.NewBatch()
+	result := new(resultEcho)
+	call, err := batch.Call("echo", map[string]interface{}{"arg": "one"}, result)
+	require.NoError(t, err)
+	calls, err := batch.Send()
+	require.NoError(t, err)
+	assert.NoError(t, call.Error)
+	assert.Equal(t, "one", result.Value)
+	assert.Equal(t, [][]*BatchCall{calls}, batches)
+}
@@ -2,6 +2,7 @@ package krpcc
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
@@ -10,6 +11,7 @@ import (
 	"net/url"
 	"reflect"
 	"strings"
+	"time"
 
 	"github.com/pkg/errors"
 	"github.com/tendermint/go-amino"
@@ -26,15 +28,57 @@ const (
 	protoTCP   = "tcp"
 )
 
-// HTTPClient is a common interface for JSONRPCClient and URIClient.
+// HTTPClient is a common interface for JSONRPCClient and URIClient. The
+// result of a call is amino decoded into result, except for a
+// *json.RawMessage, which gets the JSON of the result as is.
 type HTTPClient interface {
-	Call(method string, params map[string]interface{}, result interface{}) (interface{}, error)
+	Call(method string, params map[string]interface{}, result interface{}) error
+	CallContext(ctx context.Context, method string, params map[string]interface{}, result interface{}) error
 	Codec() *amino.Codec
 	SetCodec(*amino.Codec)
 }
 
+var (
+	_ HTTPClient = (*JSONRPCClient)(nil)
+	_ HTTPClient = (*URIClient)(nil)
+)
+
+// HTTPClientOption configures a JSONRPCClient or URIClient.
+type HTTPClientOption func(*httpClientOptions)
+
+type httpClientOptions struct {
+	timeout      time.Duration
+	dialTimeout  time.Duration
+	interceptors []Interceptor
+}
+
+// Timeout sets the default timeout of a call, applied when the context of the
+// call has no deadline. 0 means no timeout.
+func Timeout(timeout time.Duration) HTTPClientOption {
+	return func(o *httpClientOptions) {
+		o.timeout = timeout
+	}
+}
+
+// DialTimeout sets the maximum amount of time a dial to the server will wait
+// for a connect to complete. 0 means no timeout.
+func DialTimeout(timeout time.Duration) HTTPClientOption {
+	return func(o *httpClientOptions) {
+		o.dialTimeout = timeout
+	}
+}
+
+// withTimeout applies the default timeout to ctx, unless it already has a
+// deadline.
+func withTimeout(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if _, ok := ctx.Deadline(); ok || timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, timeout)
+}
+
 // TODO: Deprecate support for IP:PORT or /path/to/socket
-func makeHTTPDialer(remoteAddr string) (string, string, func(string, string) (net.Conn, error)) {
+func makeHTTPDialer(remoteAddr string, dialTimeout time.Duration) (string, string, func(string, string) (net.Conn, error)) {
 	// protocol to use for http operations, to support both http and https
 	clientProtocol := protoHTTP
 
@@ -60,19 +104,20 @@ func makeHTTPDialer(remoteAddr string) (string, string, func(string, string) (ne
 		protocol = protoTCP
 	case protoWS, protoWSS:
 		clientProtocol = protocol
+		protocol = protoTCP
 	}
 
 	// replace / with . for http requests (kvstore domain)
 	trimmedAddress := strings.Replace(address, "/", ".", -1)
 	return clientProtocol, trimmedAddress, func(proto, addr string) (net.Conn, error) {
-		return net.Dial(protocol, address)
+		return net.DialTimeout(protocol, address, dialTimeout)
 	}
 }
 
 // We overwrite the http.Client.Dial so we can do http over tcp or unix.
 // remoteAddr should be fully featured (eg. with tcp:// or unix://)
-func makeHTTPClient(remoteAddr string) (string, *http.Client) {
-	protocol, address, dialer := makeHTTPDialer(remoteAddr)
+func makeHTTPClient(remoteAddr string, dialTimeout time.Duration) (string, *http.Client) {
+	protocol, address, dialer := makeHTTPDialer(remoteAddr, dialTimeout)
 	return protocol + "://" + address, &http.Client{
 		Transport: &http.Transport{
 			Dial: dialer,
@@ -87,20 +132,41 @@ type JSONRPCClient struct {
 	address string
 	client  *http.Client
 	cdc     *amino.Codec
+	timeout time.Duration
+
+	interceptor Interceptor
 }
 
 // NewJSONRPCClient returns a JSONRPCClient pointed at the given address.
-func NewJSONRPCClient(remote string) *JSONRPCClient {
-	address, client := makeHTTPClient(remote)
+func NewJSONRPCClient(remote string, options ...HTTPClientOption) *JSONRPCClient {
+	var opts httpClientOptions
+	for _, option := range options {
+		option(&opts)
+	}
+	address, client := makeHTTPClient(remote, opts.dialTimeout)
 	return &JSONRPCClient{
 		address: address,
 		client:  client,
 		cdc:     amino.NewCodec(),
+		timeout: opts.timeout,
+
+		interceptor: ChainInterceptors(opts.interceptors...),
 	}
 }
 
+// Call calls method and unmarshals its result into result.
 func (c *JSONRPCClient) Call(method string, params map[string]interface{}, result interface{}) error {
-	request, err := types.MapToRequest(c.cdc, uuid.New().String(), method, params)
+	return c.CallContext(context.Background(), method, params, result)
+}
+
+// CallContext is like Call, but the call is aborted when ctx is done.
+func (c *JSONRPCClient) CallContext(ctx context.Context, method string, params map[string]interface{}, result interface{}) error {
+	info := &CallInfo{Method: method, Params: params, Result: result, Header: make(http.Header)}
+	return intercept(ctx, c.interceptor, info, c.call)
+}
+
+func (c *JSONRPCClient) call(ctx context.Context, info *CallInfo) error {
+	request, err := types.MapToRequest(c.cdc, types.StringID(uuid.New().String()), info.Method, info.Params)
 	if err != nil {
 		return err
 	}
@@ -108,21 +174,79 @@ func (c *JSONRPCClient) Call(method string, params map[string]interface{}, resul
 	if err != nil {
 		return err
 	}
+	logger.Info().Msg(fmt.Sprintf("RPC request to %v (%v): %v", c.client, info.Method, string(requestBytes)))
+	responseBytes, err := c.post(ctx, requestBytes, info.Header)
+	if err != nil {
+		return err
+	}
+	return unmarshalResponseBytes(c.cdc, responseBytes, info.Result)
+}
+
+// Notify calls method without waiting for its result. The server executes
+// the notification but does not reply.
+func (c *JSONRPCClient) Notify(method string, params map[string]interface{}) error {
+	info := &CallInfo{Method: method, Params: params, Header: make(http.Header), Notification: true}
+	return intercept(context.Background(), c.interceptor, info, c.notify)
+}
+
+func (c *JSONRPCClient) notify(ctx context.Context, info *CallInfo) error {
+	request, err := types.MapToRequest(c.cdc, types.JSONRPCID{}, info.Method, info.Params)
+	if err != nil {
+		return err
+	}
+	requestBytes, err := json.Marshal(request)
+	if err != nil {
+		return err
+	}
+	logger.Info().Msg(fmt.Sprintf("RPC notification to %v (%v): %v", c.client, info.Method, string(requestBytes)))
+	responseBytes, err := c.post(ctx, requestBytes, info.Header)
+	if err != nil {
+		return err
+	}
+	// The server only replies if it could not parse the notification.
+	if len(bytes.TrimSpace(responseBytes)) == 0 {
+		return nil
+	}
+	response := &types.RPCResponse{}
+	if err := json.Unmarshal(responseBytes, response); err != nil {
+		return errors.Errorf("Error unmarshalling rpc response: %v", err)
+	}
+	if response.Error != nil {
+		return response.Error
+	}
+	return nil
+}
+
+// NewBatch starts a batch of calls which are sent to the server in a single
+// request.
+func (c *JSONRPCClient) NewBatch() *JSONRPCBatch {
+	return &JSONRPCBatch{client: c}
+}
+
+func (c *JSONRPCClient) post(ctx context.Context, requestBytes []byte, header http.Header) ([]byte, error) {
+	ctx, cancel := withTimeout(ctx, c.timeout)
+	defer cancel()
+
 	logger.Debug().Msg(string(requestBytes))
 	requestBuf := bytes.NewBuffer(requestBytes)
-	logger.Info().Msg(fmt.Sprintf("RPC request to %v (%v): %v", c.client, method, string(requestBytes)))
-	httpResponse, err := c.client.Post(c.address, "text/json", requestBuf)
+	httpRequest, err := http.NewRequestWithContext(ctx, "POST", c.address, requestBuf)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	setHeader(httpRequest, header)
+	httpRequest.Header.Set("Content-Type", "text/json")
+	httpResponse, err := c.client.Do(httpRequest)
+	if err != nil {
+		return nil, err
 	}
 	defer httpResponse.Body.Close() // nolint: errcheck
 
 	responseBytes, err := ioutil.ReadAll(httpResponse.Body)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	logger.Info().Msg(fmt.Sprintf("RPC response: %v", string(responseBytes)))
-	return unmarshalResponseBytes(c.cdc, responseBytes, result)
+	return responseBytes, nil
 }
 
 func (c *JSONRPCClient) Codec() *amino.Codec {
@@ -140,24 +264,54 @@ type URIClient struct {
 	address string
 	client  *http.Client
 	cdc     *amino.Codec
+	timeout time.Duration
+
+	interceptor Interceptor
 }
 
-func NewURIClient(remote string) *URIClient {
-	address, client := makeHTTPClient(remote)
+func NewURIClient(remote string, options ...HTTPClientOption) *URIClient {
+	var opts httpClientOptions
+	for _, option := range options {
+		option(&opts)
+	}
+	address, client := makeHTTPClient(remote, opts.dialTimeout)
 	return &URIClient{
 		address: address,
 		client:  client,
 		cdc:     amino.NewCodec(),
+		timeout: opts.timeout,
+
+		interceptor: ChainInterceptors(opts.interceptors...),
 	}
 }
 
+// Call calls method and unmarshals its result into result.
 func (c *URIClient) Call(method string, params map[string]interface{}, result interface{}) error {
-	values, err := argsToURLValues(c.cdc, params)
+	return c.CallContext(context.Background(), method, params, result)
+}
+
+// CallContext is like Call, but the call is aborted when ctx is done.
+func (c *URIClient) CallContext(ctx context.Context, method string, params map[string]interface{}, result interface{}) error {
+	info := &CallInfo{Method: method, Params: params, Result: result, Header: make(http.Header)}
+	return intercept(ctx, c.interceptor, info, c.call)
+}
+
+func (c *URIClient) call(ctx context.Context, info *CallInfo) error {
+	ctx, cancel := withTimeout(ctx, c.timeout)
+	defer cancel()
+
+	values, err := argsToURLValues(c.cdc, info.Params)
 	if err != nil {
 		return err
 	}
-	logger.Info().Msg(fmt.Sprintf("URI request to %v (%v): %v", c.address, method, values))
-	resp, err := c.client.PostForm(c.address+"/"+method, values)
+	logger.Info().Msg(fmt.Sprintf("URI request to %v (%v): %v", c.address, info.Method, values))
+	httpRequest, err := http.NewRequestWithContext(ctx, "POST", c.address+"/"+info.Method, strings.NewReader(values.Encode()))
+	if err != nil {
+		return err
+	}
+	setHeader(httpRequest, info.Header)
+	httpRequest.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := c.client.Do(httpRequest)
 	if err != nil {
 		return err
 	}
@@ -167,7 +321,7 @@ func (c *URIClient) Call(method string, params map[string]interface{}, result in
 	if err != nil {
 		return err
 	}
-	return unmarshalResponseBytes(c.cdc, responseBytes, result)
+	return unmarshalResponseBytes(c.cdc, responseBytes, info.Result)
 }
 
 func (c *URIClient) Codec() *amino.Codec {
@@ -184,17 +338,32 @@ func unmarshalResponseBytes(cdc *amino.Codec, responseBytes []byte, result inter
 	// Read response.  If rpc/core/types is imported, the result will unmarshal
 	// into the correct type.
 	logger.Debug().Msg(string(responseBytes))
-	var err error
 	response := &types.RPCResponse{}
-	err = json.Unmarshal(responseBytes, response)
+	err := json.Unmarshal(responseBytes, response)
 	if err != nil {
 		return errors.Errorf("Error unmarshalling rpc response: %v", err)
 	}
+	return unmarshalResponse(cdc, response, result)
+}
+
+// unmarshalResponse unmarshals the result of response into result. An error
+// response is returned as its *types.RPCError, which matches the error
+// registered for its code with errors.Is.
+func unmarshalResponse(cdc *amino.Codec, response *types.RPCResponse, result interface{}) error {
 	if response.Error != nil {
-		return errors.Errorf("Response error: %v", response.Error)
+		return response.Error
+	}
+	// The result of functions returning only an error may be discarded.
+	if result == nil {
+		return nil
+	}
+	// A json.RawMessage gets the result as is.
+	if raw, ok := result.(*json.RawMessage); ok {
+		*raw = append((*raw)[:0], response.Result...)
+		return nil
 	}
 	// Unmarshal the RawMessage into the result.
-	err = cdc.UnmarshalJSON(response.Result, result)
+	err := cdc.UnmarshalJSON(response.Result, result)
 	if err != nil {
 		return errors.Errorf("Error unmarshalling rpc response result: %v", err)
 	}
@@ -206,11 +375,16 @@ func argsToURLValues(cdc *amino.Codec, args map[string]interface{}) (url.Values,
 	if len(args) == 0 {
 		return values, nil
 	}
-	err := argsToJSON(cdc, args)
+	// encode a copy, the caller's params may be sent again
+	encoded := make(map[string]interface{}, len(args))
+	for key, val := range args {
+		encoded[key] = val
+	}
+	err := argsToJSON(cdc, encoded)
 	if err != nil {
 		return nil, err
 	}
-	for key, val := range args {
+	for key, val := range encoded {
 		values.Set(key, val.(string))
 	}
 	return values, nil
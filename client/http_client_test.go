@@ -0,0 +1,186 @@
+package krpcc
+
+import (
+	"context"
+	"encoding/json"
+	stderrors "errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tendermint/go-amino"
+
+	krpcs "github.com/kooksee/krpc/server"
+	types "github.com/kooksee/krpc/types"
+)
+
+func TestJSONRPCNotify(t *testing.T) {
+	notified := make(chan string, 1)
+	s := newHTTPServerWith(map[string]*krpcs.RPCFunc{
+		"note": krpcs.NewRPCFunc(func(s string) (*resultEcho, error) { notified <- s; return &resultEcho{s}, nil }, "arg"),
+	})
+	defer s.Close()
+	c := NewJSONRPCClient("tcp://" + s.Listener.Addr().String())
+
+	require.NoError(t, c.Notify("note", map[string]interface{}{"arg": "hi"}))
+	assert.Equal(t, "hi", <-notified)
+}
+
+func TestCallContext(t *testing.T) {
+	release := make(chan struct{})
+	s := newHTTPServerWith(map[string]*krpcs.RPCFunc{
+		"slow": krpcs.NewRPCFunc(func() (*resultEcho, error) { <-release; return &resultEcho{}, nil }, ""),
+	})
+	defer s.Close()
+	// unblock the slow handlers before the server waits for them
+	defer close(release)
+	addr := "tcp://" + s.Listener.Addr().String()
+
+	for _, c := range []HTTPClient{NewJSONRPCClient(addr), NewURIClient(addr)} {
+		result := new(resultEcho)
+		require.NoError(t, c.CallContext(context.Background(), "echo", map[string]interface{}{"arg": "hi"}, result))
+		assert.Equal(t, "hi", result.Value)
+
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		err := c.CallContext(ctx, "slow", map[string]interface{}{}, result)
+		cancel()
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "context deadline exceeded")
+	}
+
+	for _, c := range []HTTPClient{NewJSONRPCClient(addr, Timeout(50*time.Millisecond)), NewURIClient(addr, Timeout(50*time.Millisecond))} {
+		err := c.Call("slow", map[string]interface{}{}, new(resultEcho))
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "context deadline exceeded")
+	}
+}
+
+func TestClientInterceptors(t *testing.T) {
+	attempts := 0
+	funcMap := map[string]*krpcs.RPCFunc{
+		"flaky": krpcs.NewRPCFunc(func(s string) (*resultEcho, error) {
+			attempts++
+			if attempts%2 == 1 {
+				return nil, errors.New("try again")
+			}
+			return &resultEcho{s}, nil
+		}, "arg"),
+	}
+	mux := http.NewServeMux()
+	krpcs.RegisterRPCFuncs(mux, funcMap, amino.NewCodec())
+	headers := make(chan string, 10)
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		headers <- r.Header.Get("Authorization")
+		mux.ServeHTTP(w, r)
+	}))
+	defer s.Close()
+	addr := "tcp://" + s.Listener.Addr().String()
+
+	var methods []string
+	auth := func(ctx context.Context, info *CallInfo, next Invoker) error {
+		methods = append(methods, info.Method)
+		info.Header.Set("Authorization", "Bearer token")
+		return next(ctx, info)
+	}
+	retry := func(ctx context.Context, info *CallInfo, next Invoker) error {
+		if err := next(ctx, info); err != nil {
+			return next(ctx, info)
+		}
+		return nil
+	}
+
+	for _, c := range []HTTPClient{
+		NewJSONRPCClient(addr, WithInterceptors(auth, retry)),
+		NewURIClient(addr, WithInterceptors(auth, retry)),
+	} {
+		methods = nil
+		result := new(resultEcho)
+		require.NoError(t, c.Call("flaky", map[string]interface{}{"arg": "hi"}, result))
+		assert.Equal(t, "hi", result.Value)
+		assert.Equal(t, []string{"flaky"}, methods)
+		assert.Equal(t, "Bearer token", <-headers)
+		assert.Equal(t, "Bearer token", <-headers)
+	}
+}
+
+var errNotFound = errors.New("not found")
+
+func init() {
+	types.RegisterError(1404, errNotFound)
+}
+
+func TestRawResult(t *testing.T) {
+	s := newHTTPServerWith(map[string]*krpcs.RPCFunc{})
+	defer s.Close()
+	addr := "tcp://" + s.Listener.Addr().String()
+
+	for _, c := range []HTTPClient{NewJSONRPCClient(addr), NewURIClient(addr)} {
+		var doc json.RawMessage
+		require.NoError(t, c.Call(krpcs.DiscoverMethod, nil, &doc))
+		var discovered krpcs.OpenRPCDocument
+		require.NoError(t, json.Unmarshal(doc, &discovered), "%s", doc)
+		assert.Equal(t, krpcs.OpenRPCVersion, discovered.OpenRPC)
+		assert.NotEmpty(t, discovered.Methods)
+	}
+
+	// a byte slice result is sent base64 encoded, and decoded unless it is
+	// read raw
+	s = newHTTPServerWith(map[string]*krpcs.RPCFunc{
+		"bytes": krpcs.NewRPCFunc(func() ([]byte, error) { return []byte{1, 2}, nil }, ""),
+	})
+	defer s.Close()
+	c := NewJSONRPCClient("tcp://" + s.Listener.Addr().String())
+	var b []byte
+	require.NoError(t, c.Call("bytes", nil, &b))
+	assert.Equal(t, []byte{1, 2}, b)
+	var raw json.RawMessage
+	require.NoError(t, c.Call("bytes", nil, &raw))
+	assert.Equal(t, `"AQI="`, string(raw))
+}
+
+func TestTypedErrors(t *testing.T) {
+	s := newHTTPServerWith(map[string]*krpcs.RPCFunc{
+		"lookup": krpcs.NewRPCFunc(func(key string) (*resultEcho, error) {
+			return nil, errors.Wrap(errNotFound, key)
+		}, "arg"),
+		"lookup_w": krpcs.NewRPCFunc(func(key string) (*resultEcho, error) {
+			return nil, fmt.Errorf("%s: %w", key, errNotFound)
+		}, "arg"),
+		"int": krpcs.NewRPCFunc(func(i int) (*resultEcho, error) { return &resultEcho{}, nil }, "arg"),
+	})
+	defer s.Close()
+	addr := "tcp://" + s.Listener.Addr().String()
+
+	for _, c := range []HTTPClient{NewJSONRPCClient(addr), NewURIClient(addr)} {
+		err := c.Call("lookup", map[string]interface{}{"arg": "k"}, new(resultEcho))
+		assert.True(t, stderrors.Is(err, errNotFound), "unexpected error %v", err)
+		rpcErr, ok := types.AsRPCError(err)
+		if assert.True(t, ok) {
+			assert.Equal(t, 1404, rpcErr.Code)
+			assert.Equal(t, "k: not found", rpcErr.Message)
+		}
+
+		// wrapped with the standard library
+		err = c.Call("lookup_w", map[string]interface{}{"arg": "k"}, new(resultEcho))
+		assert.True(t, stderrors.Is(err, errNotFound), "unexpected error %v", err)
+		rpcErr, ok = types.AsRPCError(err)
+		if assert.True(t, ok) {
+			assert.Equal(t, 1404, rpcErr.Code)
+			assert.Equal(t, "k: not found", rpcErr.Message)
+		}
+
+		err = c.Call("fail", map[string]interface{}{}, new(resultEcho))
+		assert.True(t, types.IsInternalError(err), "unexpected error %v", err)
+		assert.False(t, stderrors.Is(err, errNotFound))
+	}
+
+	err := NewJSONRPCClient(addr).Call("nope", nil, new(resultEcho))
+	assert.True(t, types.IsMethodNotFound(err), "unexpected error %v", err)
+	err = NewJSONRPCClient(addr).Call("int", map[string]interface{}{"arg": "x"}, new(resultEcho))
+	assert.True(t, types.IsInvalidParams(err), "unexpected error %v", err)
+}
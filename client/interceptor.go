@@ -0,0 +1,82 @@
+package krpcc
+
+import (
+	"context"
+	"net/http"
+)
+
+// CallInfo describes an outgoing call to interceptors. Interceptors may modify
+// Method, Params and Header before passing the call on. A batch sent by
+// JSONRPCBatch.Send is intercepted as a single call, whose Method, Params and
+// Result are unset.
+type CallInfo struct {
+	Method string
+	Params map[string]interface{}
+	// Result is the value the result is unmarshalled into. It is nil for
+	// notifications.
+	Result interface{}
+	// Header is added to the headers of the HTTP request.
+	Header http.Header
+	// Notification is true for calls made by JSONRPCClient.Notify.
+	Notification bool
+	// Batch holds the calls of a batch, and is nil for other calls.
+	Batch []*BatchCall
+}
+
+// Invoker sends the call described by info and decodes its result.
+type Invoker func(ctx context.Context, info *CallInfo) error
+
+// Interceptor wraps an outgoing call. It may alter the call, return early
+// without calling next, call next more than once (e.g. to retry), or inspect
+// the returned error.
+type Interceptor func(ctx context.Context, info *CallInfo, next Invoker) error
+
+// ChainInterceptors returns an Interceptor which runs interceptors in order,
+// the first one being the outermost. It returns nil if no interceptors are
+// given.
+func ChainInterceptors(interceptors ...Interceptor) Interceptor {
+	switch len(interceptors) {
+	case 0:
+		return nil
+	case 1:
+		return interceptors[0]
+	}
+	return func(ctx context.Context, info *CallInfo, next Invoker) error {
+		return interceptors[0](ctx, info, chainedInvoker(interceptors[1:], next))
+	}
+}
+
+func chainedInvoker(interceptors []Interceptor, next Invoker) Invoker {
+	if len(interceptors) == 0 {
+		return next
+	}
+	return func(ctx context.Context, info *CallInfo) error {
+		return interceptors[0](ctx, info, chainedInvoker(interceptors[1:], next))
+	}
+}
+
+// WithInterceptors sets the interceptors wrapping every call of the client,
+// the first one being the outermost. Batches are intercepted as a whole, see
+// CallInfo.Batch.
+func WithInterceptors(interceptors ...Interceptor) HTTPClientOption {
+	return func(o *httpClientOptions) {
+		o.interceptors = append(o.interceptors, interceptors...)
+	}
+}
+
+// intercept runs invoker for info through interceptor, which may be nil.
+func intercept(ctx context.Context, interceptor Interceptor, info *CallInfo, invoker Invoker) error {
+	if interceptor == nil {
+		return invoker(ctx, info)
+	}
+	return interceptor(ctx, info, invoker)
+}
+
+// setHeader adds header to the headers of r.
+func setHeader(r *http.Request, header http.Header) {
+	for key, values := range header {
+		for _, value := range values {
+			r.Header.Add(key, value)
+		}
+	}
+}
@@ -0,0 +1,588 @@
+package krpcc
+
+import (
+	"context"
+	"encoding/json"
+	"math/rand"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
+	"github.com/pkg/errors"
+	"github.com/tendermint/go-amino"
+
+	types "github.com/kooksee/krpc/types"
+)
+
+const (
+	defaultMaxReconnectAttempts = 25
+	defaultResponsesBufferSize  = 100
+	defaultMaxReconnectBackoff  = 2 * time.Minute
+	defaultWriteWait            = 0
+	defaultReadWait             = 0
+	defaultPingPeriod           = 0
+)
+
+// WSClient is a WebSocket client. The methods of WSClient are safe for use by
+// multiple goroutines.
+type WSClient struct {
+	conn *websocket.Conn
+	cdc  *amino.Codec
+
+	Address  string // IP:PORT or /path/to/socket
+	Endpoint string // /websocket/url/endpoint
+	Dialer   func(string, string) (net.Conn, error)
+
+	protocol string // ws or wss
+
+	// Single user facing channel to read RPCResponses from, closed only when the
+	// client is being stopped. Responses to requests sent with Call are handed
+	// to the caller instead; everything else (e.g. responses to Send and events
+	// pushed by the server) arrives here. The channel is buffered (see
+	// ResponsesBufferSize) and must be read by the user: responses arriving
+	// while the buffer is full are dropped, so that reading the connection,
+	// and with it the responses to Call, is never blocked.
+	ResponsesCh chan types.RPCResponse
+
+	// Callback, which will be called each time after successful reconnect.
+	onReconnect func()
+
+	// internal channels
+	send            chan types.RPCRequest // user requests
+	backlog         chan types.RPCRequest // stores a single user request received during a conn failure
+	reconnectAfter  chan error            // reconnect requests
+	readRoutineQuit chan struct{}         // a way for readRoutine to close writeRoutine
+	quit            chan struct{}         // closed by Stop
+
+	wg       sync.WaitGroup
+	stopOnce sync.Once
+
+	mtx          sync.RWMutex
+	reconnecting bool
+	// calls waiting for their response, by request ID
+	pending map[types.JSONRPCID]chan callResult
+
+	// Capacity of ResponsesCh.
+	responsesBufferSize int
+
+	// Maximum reconnect attempts (0 or greater; default: 25).
+	maxReconnectAttempts int
+
+	// Upper bound of the backoff between two reconnect attempts.
+	maxReconnectBackoff time.Duration
+
+	// Time allowed to write a message to the server. 0 means block until operation succeeds.
+	writeWait time.Duration
+
+	// Time allowed to read the next message from the server. 0 means block until operation succeeds.
+	readWait time.Duration
+
+	// Send pings to server with this period. Must be less than readWait. If 0, no pings will be sent.
+	pingPeriod time.Duration
+}
+
+// NewWSClient returns a new client. See the commentary on the func(*WSClient)
+// functions for a detailed description of how to configure ping period and
+// pong wait time. The endpoint argument must begin with a `/`.
+func NewWSClient(remoteAddr, endpoint string, options ...func(*WSClient)) *WSClient {
+	protocol, addr, dialer := makeHTTPDialer(remoteAddr, 0)
+	// default to ws protocol, unless wss is explicitly specified
+	if protocol != protoWSS {
+		protocol = protoWS
+	}
+
+	c := &WSClient{
+		cdc:                  amino.NewCodec(),
+		Address:              addr,
+		Dialer:               dialer,
+		Endpoint:             endpoint,
+		protocol:             protocol,
+		pending:              make(map[types.JSONRPCID]chan callResult),
+		responsesBufferSize:  defaultResponsesBufferSize,
+		maxReconnectAttempts: defaultMaxReconnectAttempts,
+		maxReconnectBackoff:  defaultMaxReconnectBackoff,
+		readWait:             defaultReadWait,
+		writeWait:            defaultWriteWait,
+		pingPeriod:           defaultPingPeriod,
+	}
+	for _, option := range options {
+		option(c)
+	}
+	c.ResponsesCh = make(chan types.RPCResponse, c.responsesBufferSize)
+	c.quit = make(chan struct{})
+	return c
+}
+
+// ResponsesBufferSize sets the capacity of ResponsesCh (default: 100).
+// It should only be used in the constructor and is not Goroutine-safe.
+func ResponsesBufferSize(size int) func(*WSClient) {
+	return func(c *WSClient) {
+		c.responsesBufferSize = size
+	}
+}
+
+// MaxReconnectAttempts sets the maximum number of reconnect attempts before returning an error.
+// It should only be used in the constructor and is not Goroutine-safe.
+func MaxReconnectAttempts(max int) func(*WSClient) {
+	return func(c *WSClient) {
+		c.maxReconnectAttempts = max
+	}
+}
+
+// MaxReconnectBackoff caps the exponentially growing delay between two
+// reconnect attempts.
+// It should only be used in the constructor and is not Goroutine-safe.
+func MaxReconnectBackoff(max time.Duration) func(*WSClient) {
+	return func(c *WSClient) {
+		c.maxReconnectBackoff = max
+	}
+}
+
+// ReadWait sets the amount of time to wait before a websocket read times out.
+// It should only be used in the constructor and is not Goroutine-safe.
+func ReadWait(readWait time.Duration) func(*WSClient) {
+	return func(c *WSClient) {
+		c.readWait = readWait
+	}
+}
+
+// WriteWait sets the amount of time to wait before a websocket write times out.
+// It should only be used in the constructor and is not Goroutine-safe.
+func WriteWait(writeWait time.Duration) func(*WSClient) {
+	return func(c *WSClient) {
+		c.writeWait = writeWait
+	}
+}
+
+// PingPeriod sets the duration for sending websocket pings.
+// It should only be used in the constructor - not Goroutine-safe.
+func PingPeriod(pingPeriod time.Duration) func(*WSClient) {
+	return func(c *WSClient) {
+		c.pingPeriod = pingPeriod
+	}
+}
+
+// OnReconnect sets the callback, which will be called every time after
+// successful reconnect.
+func OnReconnect(cb func()) func(*WSClient) {
+	return func(c *WSClient) {
+		c.onReconnect = cb
+	}
+}
+
+// String returns WS client full address.
+func (c *WSClient) String() string {
+	return c.protocol + "://" + c.Address + c.Endpoint
+}
+
+// Start dials the specified service address and starts the I/O routines.
+func (c *WSClient) Start() error {
+	err := c.dial()
+	if err != nil {
+		return err
+	}
+
+	c.send = make(chan types.RPCRequest)
+	// 1 additional error may come from the read/write
+	// goroutine depending on which failed first.
+	c.reconnectAfter = make(chan error, 1)
+	// capacity for 1 request. a user won't be able to send more because the send
+	// channel is unbuffered.
+	c.backlog = make(chan types.RPCRequest, 1)
+
+	c.startReadWriteRoutines()
+	go c.reconnectRoutine()
+
+	return nil
+}
+
+// Stop shuts down the client. It is safe to call more than once, and before
+// Start.
+func (c *WSClient) Stop() {
+	c.stopOnce.Do(func() {
+		// under the lock, so that no routines are started after it, see
+		// restartReadWriteRoutines
+		c.mtx.Lock()
+		close(c.quit)
+		c.mtx.Unlock()
+		// only close user-facing channels when we can't write to them
+		c.wg.Wait()
+		close(c.ResponsesCh)
+	})
+}
+
+// IsReconnecting returns true if the client is reconnecting right now.
+func (c *WSClient) IsReconnecting() bool {
+	c.mtx.RLock()
+	defer c.mtx.RUnlock()
+	return c.reconnecting
+}
+
+// IsActive returns true if the client is running and not reconnecting.
+func (c *WSClient) IsActive() bool {
+	select {
+	case <-c.quit:
+		return false
+	default:
+		return !c.IsReconnecting()
+	}
+}
+
+// Send the given RPC request to the server. Blocks until the request is
+// written to the send channel or the context is cancelled. The response, if
+// any, is delivered on ResponsesCh.
+func (c *WSClient) Send(ctx context.Context, request types.RPCRequest) error {
+	select {
+	case c.send <- request:
+		logger.Info().Str("request", request.String()).Msg("sent a request")
+		return nil
+	case <-c.quit:
+		return errors.New("client is stopped")
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Call the given method on the server and wait for its response, which is
+// unmarshalled into result. Concurrent calls are matched to their responses
+// by request ID. A call fails when the connection is lost before its
+// response arrives; it is not retried after reconnecting.
+func (c *WSClient) Call(ctx context.Context, method string, params map[string]interface{}, result interface{}) error {
+	request, err := types.MapToRequest(c.cdc, types.StringID(uuid.New().String()), method, params)
+	if err != nil {
+		return err
+	}
+
+	respCh := make(chan callResult, 1)
+	c.mtx.Lock()
+	c.pending[request.ID] = respCh
+	c.mtx.Unlock()
+	defer func() {
+		c.mtx.Lock()
+		delete(c.pending, request.ID)
+		c.mtx.Unlock()
+	}()
+
+	if err := c.Send(ctx, request); err != nil {
+		return err
+	}
+
+	select {
+	case res := <-respCh:
+		if res.err != nil {
+			return res.err
+		}
+		return unmarshalResponse(c.cdc, &res.response, result)
+	case <-c.quit:
+		return errors.New("client is stopped")
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// callResult is the response to a call, or the error the call failed with.
+type callResult struct {
+	response types.RPCResponse
+	err      error
+}
+
+// failPending fails all the calls waiting for their response with err.
+func (c *WSClient) failPending(err error) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	for id, respCh := range c.pending {
+		// respCh is buffered and only ever receives one result
+		select {
+		case respCh <- callResult{err: err}:
+		default:
+		}
+		delete(c.pending, id)
+	}
+}
+
+func (c *WSClient) Codec() *amino.Codec {
+	return c.cdc
+}
+
+func (c *WSClient) SetCodec(cdc *amino.Codec) {
+	c.cdc = cdc
+}
+
+///////////////////////////////////////////////////////////////////////////////
+// Private methods
+
+func (c *WSClient) dial() error {
+	dialer := &websocket.Dialer{
+		NetDial: c.Dialer,
+		Proxy:   http.ProxyFromEnvironment,
+	}
+	rHeader := http.Header{}
+	conn, _, err := dialer.Dial(c.String(), rHeader)
+	if err != nil {
+		return err
+	}
+	c.conn = conn
+	return nil
+}
+
+// reconnect tries to redial up to maxReconnectAttempts with exponential
+// backoff.
+func (c *WSClient) reconnect() error {
+	attempt := 0
+	backoff := time.Second
+
+	c.mtx.Lock()
+	c.reconnecting = true
+	c.mtx.Unlock()
+	defer func() {
+		c.mtx.Lock()
+		c.reconnecting = false
+		c.mtx.Unlock()
+	}()
+
+	for {
+		jitter := time.Duration(rand.Float64() * float64(time.Second)) // 1s == (1e9 ns)
+		backoffDuration := jitter + backoff
+		if backoffDuration > c.maxReconnectBackoff {
+			backoffDuration = c.maxReconnectBackoff
+		}
+
+		logger.Info().Int("attempt", attempt+1).Dur("backoff_duration", backoffDuration).Msg("reconnecting")
+		select {
+		case <-time.After(backoffDuration):
+		case <-c.quit:
+			return errors.New("client is stopped")
+		}
+
+		err := c.dial()
+		if err != nil {
+			logger.Error().Err(err).Msg("failed to redial")
+		} else {
+			logger.Info().Msg("reconnected")
+			if c.onReconnect != nil {
+				go c.onReconnect()
+			}
+			return nil
+		}
+
+		attempt++
+		// stop doubling once capped, not to overflow
+		if backoff < c.maxReconnectBackoff {
+			backoff *= 2
+		}
+
+		if attempt > c.maxReconnectAttempts {
+			return errors.Wrap(err, "reached maximum reconnect attempts")
+		}
+	}
+}
+
+func (c *WSClient) startReadWriteRoutines() {
+	c.wg.Add(2)
+	c.readRoutineQuit = make(chan struct{})
+	go c.readRoutine()
+	go c.writeRoutine()
+}
+
+// restartReadWriteRoutines starts the I/O routines on the redialed connection,
+// unless the client was stopped meanwhile, in which case the connection is
+// closed and false is returned.
+func (c *WSClient) restartReadWriteRoutines() bool {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	select {
+	case <-c.quit:
+		c.conn.Close() // nolint: errcheck
+		return false
+	default:
+	}
+	c.startReadWriteRoutines()
+	return true
+}
+
+func (c *WSClient) processBacklog() error {
+	select {
+	case request := <-c.backlog:
+		if c.writeWait > 0 {
+			if err := c.conn.SetWriteDeadline(time.Now().Add(c.writeWait)); err != nil {
+				logger.Error().Err(err).Msg("failed to set write deadline")
+			}
+		}
+		if err := c.conn.WriteJSON(request); err != nil {
+			logger.Error().Err(err).Msg("failed to resend request")
+			c.reconnectAfter <- err
+			// requeue request
+			c.backlog <- request
+			return err
+		}
+		logger.Info().Str("request", request.String()).Msg("resend a request")
+	default:
+	}
+	return nil
+}
+
+func (c *WSClient) reconnectRoutine() {
+	for {
+		select {
+		case originalError := <-c.reconnectAfter:
+			// the responses to the pending calls are lost with the connection
+			c.failPending(errors.Wrap(originalError, "connection lost"))
+			// wait until writeRoutine and readRoutine finish
+			c.wg.Wait()
+			if err := c.reconnect(); err != nil {
+				logger.Error().Err(err).AnErr("original_err", originalError).Msg("failed to reconnect")
+				c.Stop()
+				return
+			}
+			// drain reconnectAfter
+		LOOP:
+			for {
+				select {
+				case <-c.reconnectAfter:
+				default:
+					break LOOP
+				}
+			}
+			err := c.processBacklog()
+			if err == nil && !c.restartReadWriteRoutines() {
+				return
+			}
+
+		case <-c.quit:
+			return
+		}
+	}
+}
+
+// The client ensures that there is at most one writer to a connection by
+// executing all writes from this goroutine.
+func (c *WSClient) writeRoutine() {
+	var ticker *time.Ticker
+	if c.pingPeriod > 0 {
+		// ticker with a predefined period
+		ticker = time.NewTicker(c.pingPeriod)
+	} else {
+		// ticker that never fires
+		ticker = &time.Ticker{C: make(<-chan time.Time)}
+	}
+
+	defer func() {
+		ticker.Stop()
+		if err := c.conn.Close(); err != nil {
+			// ignore error; it will trigger in tests
+			// likely because it's closing an already closed connection
+		}
+		c.wg.Done()
+	}()
+
+	for {
+		select {
+		case request := <-c.send:
+			if c.writeWait > 0 {
+				if err := c.conn.SetWriteDeadline(time.Now().Add(c.writeWait)); err != nil {
+					logger.Error().Err(err).Msg("failed to set write deadline")
+				}
+			}
+			if err := c.conn.WriteJSON(request); err != nil {
+				logger.Error().Err(err).Msg("failed to send request")
+				c.reconnectAfter <- err
+				// add request to the backlog, so we don't lose it
+				c.backlog <- request
+				return
+			}
+		case <-ticker.C:
+			if c.writeWait > 0 {
+				if err := c.conn.SetWriteDeadline(time.Now().Add(c.writeWait)); err != nil {
+					logger.Error().Err(err).Msg("failed to set write deadline")
+				}
+			}
+			if err := c.conn.WriteMessage(websocket.PingMessage, []byte{}); err != nil {
+				logger.Error().Err(err).Msg("failed to write ping")
+				c.reconnectAfter <- err
+				return
+			}
+			logger.Debug().Msg("sent ping")
+		case <-c.readRoutineQuit:
+			return
+		case <-c.quit:
+			if err := c.conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, "")); err != nil {
+				logger.Error().Err(err).Msg("failed to write message")
+			}
+			return
+		}
+	}
+}
+
+// The client ensures that there is at most one reader to a connection by
+// executing all reads from this goroutine.
+func (c *WSClient) readRoutine() {
+	defer func() {
+		if err := c.conn.Close(); err != nil {
+			// ignore error; it will trigger in tests
+			// likely because it's closing an already closed connection
+		}
+		c.wg.Done()
+	}()
+
+	c.conn.SetPongHandler(func(string) error {
+		logger.Debug().Msg("got pong")
+		if c.readWait > 0 {
+			return c.conn.SetReadDeadline(time.Now().Add(c.readWait))
+		}
+		return nil
+	})
+
+	for {
+		// reset deadline for every message type (control or data)
+		if c.readWait > 0 {
+			if err := c.conn.SetReadDeadline(time.Now().Add(c.readWait)); err != nil {
+				logger.Error().Err(err).Msg("failed to set read deadline")
+			}
+		}
+		_, data, err := c.conn.ReadMessage()
+		if err != nil {
+			select {
+			case <-c.quit:
+				// the connection was closed by Stop
+				return
+			default:
+			}
+
+			logger.Error().Err(err).Msg("failed to read response")
+			close(c.readRoutineQuit)
+			c.reconnectAfter <- err
+			return
+		}
+
+		var response types.RPCResponse
+		err = json.Unmarshal(data, &response)
+		if err != nil {
+			logger.Error().Err(err).Str("data", string(data)).Msg("failed to parse response")
+			continue
+		}
+		logger.Info().Str("resp", response.String()).Msg("got response")
+
+		c.mtx.RLock()
+		respCh, ok := c.pending[response.ID]
+		c.mtx.RUnlock()
+		if ok {
+			// respCh is buffered and only ever receives one result
+			select {
+			case respCh <- callResult{response: response}:
+			default:
+			}
+			continue
+		}
+
+		// never block on ResponsesCh, which would block c.wg.Wait() in c.Stop()
+		// and the responses to the pending calls
+		select {
+		case c.ResponsesCh <- response:
+		default:
+			logger.Error().Str("resp", response.String()).Msg("ResponsesCh is full, dropping response")
+		}
+	}
+}
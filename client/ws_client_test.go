@@ -0,0 +1,265 @@
+package krpcc
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tendermint/go-amino"
+
+	krpcs "github.com/kooksee/krpc/server"
+	types "github.com/kooksee/krpc/types"
+)
+
+type resultEcho struct {
+	Value string `json:"value"`
+}
+
+func newWSServer() *httptest.Server {
+	funcMap := map[string]*krpcs.RPCFunc{
+		"echo": krpcs.NewRPCFunc(func(s string) (*resultEcho, error) { return &resultEcho{s}, nil }, "arg"),
+		"push": krpcs.NewWSRPCFunc(func(wsCtx types.WSRPCContext, s string) (*resultEcho, error) {
+			wsCtx.WriteRPCResponse(types.NewRPCSuccessResponse(wsCtx.Codec(), types.StringID("event"), &resultEcho{s}))
+			return &resultEcho{s}, nil
+		}, "arg"),
+	}
+	mux := http.NewServeMux()
+	krpcs.RegisterWSFuncs(mux, "", funcMap, amino.NewCodec())
+	return httptest.NewServer(mux)
+}
+
+func startClient(t *testing.T, s *httptest.Server) *WSClient {
+	c := NewWSClient("tcp://"+s.Listener.Addr().String(), krpcs.DefaultWSPath)
+	require.NoError(t, c.Start())
+	return c
+}
+
+func TestWSClientConcurrentCalls(t *testing.T) {
+	s := newWSServer()
+	defer s.Close()
+	c := startClient(t, s)
+	defer c.Stop()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			val := fmt.Sprintf("hello %d", i)
+			result := new(resultEcho)
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			if assert.NoError(t, c.Call(ctx, "echo", map[string]interface{}{"arg": val}, result)) {
+				assert.Equal(t, val, result.Value)
+			}
+		}(i)
+	}
+	wg.Wait()
+}
+
+func TestWSClientPushedResponses(t *testing.T) {
+	s := newWSServer()
+	defer s.Close()
+	c := startClient(t, s)
+	defer c.Stop()
+
+	// the pushed response is buffered, so ResponsesCh can be read after the
+	// call returns
+	result := new(resultEcho)
+	require.NoError(t, c.Call(context.Background(), "push", map[string]interface{}{"arg": "hi"}, result))
+	assert.Equal(t, "hi", result.Value)
+
+	select {
+	case resp := <-c.ResponsesCh:
+		assert.Equal(t, types.StringID("event"), resp.ID)
+		assert.Nil(t, resp.Error)
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected a pushed response")
+	}
+}
+
+func TestWSClientMethodNotFound(t *testing.T) {
+	s := newWSServer()
+	defer s.Close()
+	c := startClient(t, s)
+	defer c.Stop()
+
+	err := c.Call(context.Background(), "nope", nil, new(resultEcho))
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "Method not found")
+}
+
+func TestWSClientReconnect(t *testing.T) {
+	started, release := make(chan struct{}, 1), make(chan struct{})
+	defer close(release)
+	funcMap := map[string]*krpcs.RPCFunc{
+		"echo": krpcs.NewRPCFunc(func(s string) (*resultEcho, error) { return &resultEcho{s}, nil }, "arg"),
+		"hang": krpcs.NewRPCFunc(func() (*resultEcho, error) {
+			started <- struct{}{}
+			<-release
+			return nil, nil
+		}, ""),
+	}
+	mux := http.NewServeMux()
+	krpcs.RegisterWSFuncs(mux, "", funcMap, amino.NewCodec())
+	s := httptest.NewServer(mux)
+	defer s.Close()
+
+	reconnected := make(chan struct{}, 1)
+	c := NewWSClient("tcp://"+s.Listener.Addr().String(), krpcs.DefaultWSPath,
+		MaxReconnectBackoff(10*time.Millisecond), OnReconnect(func() { reconnected <- struct{}{} }))
+	conns := make(chan net.Conn, 2)
+	dial := c.Dialer
+	c.Dialer = func(network, addr string) (net.Conn, error) {
+		conn, err := dial(network, addr)
+		if err == nil {
+			conns <- conn
+		}
+		return conn, err
+	}
+	require.NoError(t, c.Start())
+	defer c.Stop()
+
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- c.Call(context.Background(), "hang", nil, new(resultEcho))
+	}()
+	<-started
+	// drop the connection while the call waits for its response
+	require.NoError(t, (<-conns).Close())
+	select {
+	case err := <-errCh:
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "connection lost")
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the pending call to fail")
+	}
+
+	select {
+	case <-reconnected:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected to reconnect")
+	}
+	result := new(resultEcho)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	require.NoError(t, c.Call(ctx, "echo", map[string]interface{}{"arg": "hi"}, result))
+	assert.Equal(t, "hi", result.Value)
+}
+
+func TestWSClientMaxReconnectAttempts(t *testing.T) {
+	s := newWSServer()
+	defer s.Close()
+
+	// more attempts than the backoff can be doubled without overflowing
+	c := NewWSClient("tcp://"+s.Listener.Addr().String(), krpcs.DefaultWSPath,
+		MaxReconnectAttempts(40), MaxReconnectBackoff(time.Millisecond))
+	var conn net.Conn
+	dial := c.Dialer
+	c.Dialer = func(network, addr string) (net.Conn, error) {
+		if conn != nil {
+			return nil, errors.New("refused")
+		}
+		var err error
+		conn, err = dial(network, addr)
+		return conn, err
+	}
+	require.NoError(t, c.Start())
+	require.NoError(t, conn.Close())
+
+	// the client stops once out of attempts
+	select {
+	case _, ok := <-c.ResponsesCh:
+		assert.False(t, ok)
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the client to stop")
+	}
+	assert.False(t, c.IsActive())
+}
+
+// closeConn reports when the connection is closed, and whether websocket
+// frames were written to it after the handshake.
+type closeConn struct {
+	net.Conn
+	closed chan struct{}
+	once   sync.Once
+
+	mtx     sync.Mutex
+	written bool
+}
+
+func (c *closeConn) Write(b []byte) (int, error) {
+	if !bytes.HasPrefix(b, []byte("GET ")) {
+		c.mtx.Lock()
+		c.written = true
+		c.mtx.Unlock()
+	}
+	return c.Conn.Write(b)
+}
+
+func (c *closeConn) Close() error {
+	c.once.Do(func() { close(c.closed) })
+	return c.Conn.Close()
+}
+
+func TestWSClientStopWhileReconnecting(t *testing.T) {
+	s := newWSServer()
+	defer s.Close()
+
+	c := NewWSClient("tcp://"+s.Listener.Addr().String(), krpcs.DefaultWSPath, MaxReconnectBackoff(time.Millisecond))
+	var first net.Conn
+	redialing, proceed := make(chan struct{}), make(chan struct{})
+	redialed := &closeConn{closed: make(chan struct{})}
+	dial := c.Dialer
+	c.Dialer = func(network, addr string) (net.Conn, error) {
+		conn, err := dial(network, addr)
+		if err != nil {
+			return nil, err
+		}
+		if first == nil {
+			first = conn
+			return conn, nil
+		}
+		close(redialing)
+		<-proceed
+		redialed.Conn = conn
+		return redialed, nil
+	}
+	require.NoError(t, c.Start())
+	require.NoError(t, first.Close())
+
+	// stop the client while it redials
+	<-redialing
+	c.Stop()
+	_, ok := <-c.ResponsesCh
+	assert.False(t, ok)
+	close(proceed)
+
+	// the redialed connection is closed without starting the routines, whose
+	// writeRoutine would write a close frame
+	select {
+	case <-redialed.closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the redialed connection to be closed")
+	}
+	redialed.mtx.Lock()
+	defer redialed.mtx.Unlock()
+	assert.False(t, redialed.written)
+}
+
+func TestWSClientStopBeforeStart(t *testing.T) {
+	c := NewWSClient("tcp://localhost:0", krpcs.DefaultWSPath)
+	c.Stop()
+	c.Stop()
+	_, ok := <-c.ResponsesCh
+	assert.False(t, ok)
+}
@@ -0,0 +1,168 @@
+// Command krpc-gen generates a typed client of the RPC functions of a routes
+// map, or of the methods of a service type (see krpcs.FuncMap.RegisterService).
+//
+// Usage:
+//
+//	krpc-gen -pkg github.com/you/app/rpc -routes Routes -o client_gen.go
+//	krpc-gen -pkg github.com/you/app/rpc -service EthService -namespace eth -skip Close -o client_gen.go
+//
+// krpc-gen must be run in the Go module of the package, e.g. by a go:generate
+// directive. It builds and runs a program importing the package, which calls
+// krpcgen.Generate.
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"go/token"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"text/template"
+
+	"github.com/pkg/errors"
+)
+
+func main() {
+	var (
+		pkg       = flag.String("pkg", "", "import path of the package declaring the routes or the service")
+		routes    = flag.String("routes", "Routes", "exported map[string]*krpcs.RPCFunc variable of the package")
+		service   = flag.String("service", "", "exported service type of the package, used instead of -routes")
+		namespace = flag.String("namespace", "", "namespace of the methods of -service")
+		skip      = flag.String("skip", "", "comma separated Go methods of -service which are not RPC functions")
+		output    = flag.String("o", "", "output file, or standard output if empty")
+		pkgName   = flag.String("package", "", "package name of the generated file, by default the one of the output directory")
+		typeName  = flag.String("type", "Client", "name of the client type")
+	)
+	flag.Parse()
+	if err := run(*pkg, *routes, *service, *namespace, *skip, *output, *pkgName, *typeName); err != nil {
+		fmt.Fprintf(os.Stderr, "krpc-gen: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+func run(pkg, routes, service, namespace, skip, output, pkgName, typeName string) error {
+	if pkg == "" {
+		return errors.New("-pkg is required")
+	}
+	var skipped []string
+	if skip != "" {
+		skipped = strings.Split(skip, ",")
+	}
+	for _, name := range append([]string{routes, service, typeName}, skipped...) {
+		if name != "" && !token.IsIdentifier(name) {
+			return errors.Errorf("%q is not an identifier", name)
+		}
+	}
+
+	dir := "."
+	if output != "" {
+		dir = filepath.Dir(output)
+	}
+	pkgPath, name, err := packageOf(dir)
+	if pkgName == "" {
+		if err != nil {
+			return errors.Wrap(err, "-package is required")
+		}
+		pkgName = name
+	}
+
+	var src bytes.Buffer
+	err = programTemplate.Execute(&src, map[string]interface{}{
+		"Pkg":       pkg,
+		"Routes":    routes,
+		"Service":   service,
+		"Namespace": namespace,
+		"Skip":      skipped,
+		"Package":   pkgName,
+		"PkgPath":   pkgPath,
+		"Type":      typeName,
+	})
+	if err != nil {
+		return err
+	}
+	client, err := runProgram(src.Bytes())
+	if err != nil {
+		return err
+	}
+
+	if output == "" {
+		_, err = os.Stdout.Write(client)
+		return err
+	}
+	return ioutil.WriteFile(output, client, 0644)
+}
+
+// packageOf returns the import path and name of the package in dir.
+func packageOf(dir string) (string, string, error) {
+	cmd := exec.Command("go", "list", "-f", "{{.ImportPath}} {{.Name}}", ".")
+	cmd.Dir = dir
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return "", "", errors.Errorf("error listing the package in %s: %v: %s", dir, err, bytes.TrimSpace(stderr.Bytes()))
+	}
+	fields := strings.Fields(string(out))
+	if len(fields) != 2 {
+		return "", "", errors.Errorf("unexpected package of %s: %q", dir, out)
+	}
+	return fields[0], fields[1], nil
+}
+
+// runProgram runs the Go program src in a temporary directory of the current
+// module, returning its output.
+func runProgram(src []byte) ([]byte, error) {
+	tmp, err := ioutil.TempDir(".", "krpc_gen_")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(tmp) // nolint: errcheck
+	if err := ioutil.WriteFile(filepath.Join(tmp, "main.go"), src, 0644); err != nil {
+		return nil, err
+	}
+	cmd := exec.Command("go", "run", "./"+filepath.Base(tmp))
+	cmd.Stderr = os.Stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, errors.Wrap(err, "error running the generator")
+	}
+	return out, nil
+}
+
+var programTemplate = template.Must(template.New("main").Parse(`package main
+
+import (
+	"fmt"
+	"os"
+
+	krpcgen "github.com/kooksee/krpc/gen"
+	krpcs "github.com/kooksee/krpc/server"
+
+	routes {{printf "%q" .Pkg}}
+)
+
+func main() {
+{{- if .Service}}
+	funcMap := krpcs.FuncMap{}
+	if err := funcMap.RegisterService({{printf "%q" .Namespace}}, new(routes.{{.Service}}), krpcs.SkipMethods({{range $i, $name := .Skip}}{{if $i}}, {{end}}{{printf "%q" $name}}{{end}})); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+{{- else}}
+	var funcMap map[string]*krpcs.RPCFunc = routes.{{.Routes}}
+{{- end}}
+	err := krpcgen.Generate(os.Stdout, funcMap, krpcgen.Config{
+		Package: {{printf "%q" .Package}},
+		PkgPath: {{printf "%q" .PkgPath}},
+		Type:    {{printf "%q" .Type}},
+	})
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+`))
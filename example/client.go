@@ -11,7 +11,7 @@ func (t *_client) Echo(val string) (string, error) {
 		"arg": val,
 	}
 	result := new(ResultEcho)
-	if _, err := t.cl.Call("echo", params, result); err != nil {
+	if err := t.cl.Call("echo", params, result); err != nil {
 		return "", err
 	}
 	return result.Value, nil
@@ -22,7 +22,7 @@ func echoIntViaHTTP(cl krpcc.HTTPClient, val int) (int, error) {
 		"arg": val,
 	}
 	result := new(ResultEchoInt)
-	if _, err := cl.Call("echo_int", params, result); err != nil {
+	if err := cl.Call("echo_int", params, result); err != nil {
 		return 0, err
 	}
 	return result.Value, nil
@@ -33,7 +33,7 @@ func echoBytesViaHTTP(cl krpcc.HTTPClient, bytes []byte) ([]byte, error) {
 		"arg": bytes,
 	}
 	result := new(ResultEchoBytes)
-	if _, err := cl.Call("echo_bytes", params, result); err != nil {
+	if err := cl.Call("echo_bytes", params, result); err != nil {
 		return []byte{}, err
 	}
 	return result.Value, nil
@@ -44,7 +44,7 @@ func echoDataBytesViaHTTP(cl krpcc.HTTPClient, bytes []byte) ([]byte, error) {
 		"arg": bytes,
 	}
 	result := new(ResultEchoDataBytes)
-	if _, err := cl.Call("echo_data_bytes", params, result); err != nil {
+	if err := cl.Call("echo_data_bytes", params, result); err != nil {
 		return []byte{}, err
 	}
 	return result.Value, nil
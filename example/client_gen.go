@@ -0,0 +1,59 @@
+// Code generated by krpc-gen. DO NOT EDIT.
+
+package example
+
+import (
+	"context"
+
+	krpcc "github.com/kooksee/krpc/client"
+)
+
+// Client is a typed client of the RPC methods.
+type Client struct {
+	cl krpcc.HTTPClient
+}
+
+// NewClient returns a Client calling the RPC methods with cl.
+func NewClient(cl krpcc.HTTPClient) *Client {
+	return &Client{cl: cl}
+}
+
+// Echo calls the RPC method "echo".
+func (c *Client) Echo(ctx context.Context, arg string) (*ResultEcho, error) {
+	params := map[string]interface{}{
+		"arg": arg,
+	}
+	var result *ResultEcho
+	err := c.cl.CallContext(ctx, "echo", params, &result)
+	return result, err
+}
+
+// EchoBytes calls the RPC method "echo_bytes".
+func (c *Client) EchoBytes(ctx context.Context, arg []byte) (*ResultEchoBytes, error) {
+	params := map[string]interface{}{
+		"arg": arg,
+	}
+	var result *ResultEchoBytes
+	err := c.cl.CallContext(ctx, "echo_bytes", params, &result)
+	return result, err
+}
+
+// EchoDataBytes calls the RPC method "echo_data_bytes".
+func (c *Client) EchoDataBytes(ctx context.Context, arg []byte) (*ResultEchoDataBytes, error) {
+	params := map[string]interface{}{
+		"arg": arg,
+	}
+	var result *ResultEchoDataBytes
+	err := c.cl.CallContext(ctx, "echo_data_bytes", params, &result)
+	return result, err
+}
+
+// EchoInt calls the RPC method "echo_int".
+func (c *Client) EchoInt(ctx context.Context, arg int) (*ResultEchoInt, error) {
+	params := map[string]interface{}{
+		"arg": arg,
+	}
+	var result *ResultEchoInt
+	err := c.cl.CallContext(ctx, "echo_int", params, &result)
+	return result, err
+}
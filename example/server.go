@@ -6,12 +6,15 @@ import (
 	"net/http"
 )
 
+//go:generate go run ../cmd/krpc-gen -pkg github.com/kooksee/krpc/example -o client_gen.go
+
 // Define some routes
 var Routes = map[string]*krpcs.RPCFunc{
 	"echo":            krpcs.NewRPCFunc(EchoResult, "arg"),
 	"echo_bytes":      krpcs.NewRPCFunc(EchoBytesResult, "arg"),
 	"echo_data_bytes": krpcs.NewRPCFunc(EchoDataBytesResult, "arg"),
 	"echo_int":        krpcs.NewRPCFunc(EchoIntResult, "arg"),
+	"echo_ws":         krpcs.NewWSRPCFunc(EchoWSResult, "arg"),
 }
 
 const (
@@ -23,6 +26,10 @@ var RoutesCdc = amino.NewCodec()
 func setup() {
 	mux := http.NewServeMux()
 	krpcs.RegisterRPCFuncs(mux, Routes, RoutesCdc)
-	krpcs.StartHTTPServer(tcpAddr, mux, krpcs.Config{})
+	wm := krpcs.RegisterWSFuncs(mux, krpcs.DefaultWSPath, Routes, RoutesCdc)
+	srv := krpcs.NewServer(tcpAddr, mux, krpcs.DefaultConfig(), krpcs.WithWebsocketManagers(wm))
+	if err := srv.Start(); err != nil {
+		panic(err)
+	}
 	select {}
 }
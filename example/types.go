@@ -1,5 +1,7 @@
 package example
 
+import types "github.com/kooksee/krpc/types"
+
 type ResultEcho struct {
 	Value string `json:"value"`
 }
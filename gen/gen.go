@@ -0,0 +1,290 @@
+// Package krpcgen generates typed clients of RPC functions. It is used by the
+// krpc-gen command.
+package krpcgen
+
+import (
+	"bytes"
+	"fmt"
+	"go/format"
+	"go/token"
+	gotypes "go/types"
+	"io"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/pkg/errors"
+
+	"github.com/kooksee/krpc/server"
+)
+
+const clientImportPath = "github.com/kooksee/krpc/client"
+
+// Config configures a generated client.
+type Config struct {
+	// Package is the name of the package of the generated file.
+	Package string
+	// PkgPath is the import path of the package of the generated file. Types
+	// of this package are not qualified.
+	PkgPath string
+	// Type is the name of the client type, "Client" by default.
+	Type string
+}
+
+// Generate writes the Go source of a client of the RPC functions of funcMap to
+// w. The client wraps a krpcc.HTTPClient, with one method per function taking
+// a context.Context and the named parameters of the function, and returning
+// its result and an error. The Go method names are the camel cased RPC method
+// names, e.g. EthGetBalance for "eth_getBalance". Optional parameters are
+// pointers, and are not sent if nil. Websocket only functions are skipped.
+func Generate(w io.Writer, funcMap map[string]*krpcs.RPCFunc, config Config) error {
+	if config.Package == "" {
+		return errors.New("the package of the client is not set")
+	}
+	if config.Type == "" {
+		config.Type = "Client"
+	}
+	g := &generator{
+		pkgPath: config.PkgPath,
+		imports: map[string]string{"context": "context", clientImportPath: "krpcc"},
+		names:   map[string]bool{"context": true, "krpcc": true},
+	}
+
+	methods := make([]string, 0, len(funcMap))
+	for method := range funcMap {
+		methods = append(methods, method)
+	}
+	sort.Strings(methods)
+	goNames := make(map[string]string, len(methods))
+	var body bytes.Buffer
+	for _, method := range methods {
+		rpcFunc := funcMap[method]
+		if rpcFunc.WebsocketOnly() {
+			continue
+		}
+		name := exportedName(method)
+		if name == "" {
+			return errors.Errorf("method %q has no Go name", method)
+		}
+		if other, ok := goNames[name]; ok {
+			return errors.Errorf("methods %q and %q are both named %s", other, method, name)
+		}
+		goNames[name] = method
+		if err := g.writeMethod(&body, config.Type, name, method, rpcFunc); err != nil {
+			return errors.Wrapf(err, "method %q", method)
+		}
+	}
+
+	var src bytes.Buffer
+	fmt.Fprintf(&src, "// Code generated by krpc-gen. DO NOT EDIT.\n\npackage %s\n\nimport (\n", config.Package)
+	paths := make([]string, 0, len(g.imports))
+	for path := range g.imports {
+		paths = append(paths, path)
+	}
+	// the standard library first, like goimports
+	sort.Slice(paths, func(i, j int) bool {
+		if std := isStd(paths[i]); std != isStd(paths[j]) {
+			return std
+		}
+		return paths[i] < paths[j]
+	})
+	for i, path := range paths {
+		if i > 0 && isStd(path) != isStd(paths[i-1]) {
+			src.WriteString("\n")
+		}
+		if name := g.imports[path]; name != path[strings.LastIndex(path, "/")+1:] {
+			fmt.Fprintf(&src, "\t%s %q\n", name, path)
+		} else {
+			fmt.Fprintf(&src, "\t%q\n", path)
+		}
+	}
+	fmt.Fprintf(&src, ")\n\n")
+	fmt.Fprintf(&src, "// %s is a typed client of the RPC methods.\ntype %s struct {\n\tcl krpcc.HTTPClient\n}\n\n", config.Type, config.Type)
+	fmt.Fprintf(&src, "// New%s returns a %s calling the RPC methods with cl.\n", config.Type, config.Type)
+	fmt.Fprintf(&src, "func New%s(cl krpcc.HTTPClient) *%s {\n\treturn &%s{cl: cl}\n}\n", config.Type, config.Type, config.Type)
+	src.Write(body.Bytes())
+
+	formatted, err := format.Source(src.Bytes())
+	if err != nil {
+		return errors.Wrap(err, "error formatting the generated client")
+	}
+	_, err = w.Write(formatted)
+	return err
+}
+
+// generator keeps the imports of a generated file.
+type generator struct {
+	pkgPath string
+	imports map[string]string // import path to package name
+	names   map[string]bool   // used package names
+}
+
+// reservedNames are the identifiers used in generated methods, which
+// parameters are not named as.
+var reservedNames = map[string]bool{"c": true, "ctx": true, "params": true, "result": true, "err": true}
+
+func (g *generator) writeMethod(w io.Writer, clientType, name, method string, rpcFunc *krpcs.RPCFunc) error {
+	params := rpcFunc.Params()
+	types := make([]string, len(params))
+	for i, param := range params {
+		typ, err := g.typeString(param.Type)
+		if err != nil {
+			return errors.Wrapf(err, "parameter %q", param.Name)
+		}
+		if param.Optional {
+			typ = "*" + typ
+		}
+		types[i] = typ
+	}
+	var result string
+	if t := rpcFunc.Result(); t != nil {
+		typ, err := g.typeString(t)
+		if err != nil {
+			return errors.Wrap(err, "result")
+		}
+		result = typ
+	}
+
+	// name the arguments once the imports are known, not to shadow them
+	args := make([]string, len(params))
+	decls := []string{"ctx context.Context"}
+	for i, param := range params {
+		args[i] = g.argName(param.Name, args[:i])
+		decls = append(decls, args[i]+" "+types[i])
+	}
+
+	fmt.Fprintf(w, "\n// %s calls the RPC method %q.\n", name, method)
+	if result == "" {
+		fmt.Fprintf(w, "func (c *%s) %s(%s) error {\n", clientType, name, strings.Join(decls, ", "))
+	} else {
+		fmt.Fprintf(w, "func (c *%s) %s(%s) (%s, error) {\n", clientType, name, strings.Join(decls, ", "), result)
+	}
+	fmt.Fprintf(w, "\tparams := map[string]interface{}{\n")
+	for i, param := range params {
+		if !param.Optional {
+			fmt.Fprintf(w, "\t\t%q: %s,\n", param.Name, args[i])
+		}
+	}
+	fmt.Fprintf(w, "\t}\n")
+	for i, param := range params {
+		if param.Optional {
+			fmt.Fprintf(w, "\tif %s != nil {\n\t\tparams[%q] = *%s\n\t}\n", args[i], param.Name, args[i])
+		}
+	}
+	if result == "" {
+		fmt.Fprintf(w, "\treturn c.cl.CallContext(ctx, %q, params, nil)\n}\n", method)
+		return nil
+	}
+	fmt.Fprintf(w, "\tvar result %s\n", result)
+	fmt.Fprintf(w, "\terr := c.cl.CallContext(ctx, %q, params, &result)\n", method)
+	fmt.Fprintf(w, "\treturn result, err\n}\n")
+	return nil
+}
+
+// typeString returns the Go syntax of t, importing the packages of the named
+// types in it.
+func (g *generator) typeString(t reflect.Type) (string, error) {
+	if t.Name() != "" {
+		if t.PkgPath() == "" || t.PkgPath() == g.pkgPath {
+			return t.Name(), nil
+		}
+		return g.importName(t) + "." + t.Name(), nil
+	}
+	switch t.Kind() {
+	case reflect.Ptr:
+		elem, err := g.typeString(t.Elem())
+		return "*" + elem, err
+	case reflect.Slice:
+		if t.Elem().Kind() == reflect.Uint8 && t.Elem().Name() == "uint8" {
+			return "[]byte", nil
+		}
+		elem, err := g.typeString(t.Elem())
+		return "[]" + elem, err
+	case reflect.Array:
+		elem, err := g.typeString(t.Elem())
+		return "[" + strconv.Itoa(t.Len()) + "]" + elem, err
+	case reflect.Map:
+		key, err := g.typeString(t.Key())
+		if err != nil {
+			return "", err
+		}
+		elem, err := g.typeString(t.Elem())
+		return "map[" + key + "]" + elem, err
+	case reflect.Interface:
+		if t.NumMethod() == 0 {
+			return "interface{}", nil
+		}
+	}
+	return "", errors.Errorf("unsupported type %v", t)
+}
+
+// importName imports the package of the named type t, returning its name in
+// the generated file.
+func (g *generator) importName(t reflect.Type) string {
+	if name, ok := g.imports[t.PkgPath()]; ok {
+		return name
+	}
+	// the package name prefixes the type name in the string of named types
+	base := strings.SplitN(t.String(), ".", 2)[0]
+	name := base
+	for i := 2; g.names[name] || reservedNames[name]; i++ {
+		name = base + strconv.Itoa(i)
+	}
+	g.imports[t.PkgPath()] = name
+	g.names[name] = true
+	return name
+}
+
+func isStd(path string) bool {
+	return !strings.Contains(strings.SplitN(path, "/", 2)[0], ".")
+}
+
+// exportedName returns the camel cased Go name of an RPC method name, split
+// at characters other than letters and digits.
+func exportedName(method string) string {
+	words := strings.FieldsFunc(method, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+	for i, word := range words {
+		r, n := utf8.DecodeRuneInString(word)
+		words[i] = string(unicode.ToUpper(r)) + word[n:]
+	}
+	name := strings.Join(words, "")
+	if r, _ := utf8.DecodeRuneInString(name); !unicode.IsLetter(r) {
+		return ""
+	}
+	return name
+}
+
+// argName returns the Go name of the parameter named name, which differs from
+// the names of the previous parameters, and does not shadow an import, a
+// predeclared identifier or a name used in the method.
+func (g *generator) argName(name string, previous []string) string {
+	arg := exportedName(name)
+	if arg == "" {
+		arg = "arg"
+	} else {
+		r, n := utf8.DecodeRuneInString(arg)
+		arg = string(unicode.ToLower(r)) + arg[n:]
+	}
+	base := arg
+	for i := 2; ; i++ {
+		if !reservedNames[arg] && !g.names[arg] && !token.Lookup(arg).IsKeyword() &&
+			gotypes.Universe.Lookup(arg) == nil && !contains(previous, arg) {
+			return arg
+		}
+		arg = base + strconv.Itoa(i)
+	}
+}
+
+func contains(names []string, name string) bool {
+	for _, n := range names {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
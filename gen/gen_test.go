@@ -0,0 +1,83 @@
+package krpcgen
+
+import (
+	"bytes"
+	"context"
+	"go/parser"
+	"go/token"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/kooksee/krpc/server"
+	types "github.com/kooksee/krpc/types"
+)
+
+type result struct {
+	Value string
+}
+
+type listParams struct {
+	Query string        `json:"q" rpc:"required"`
+	Type  string        `json:"type" rpc:"optional"`
+	Wait  time.Duration `json:"wait"`
+}
+
+func TestGenerate(t *testing.T) {
+	funcMap := map[string]*krpcs.RPCFunc{
+		"echo":     krpcs.NewRPCFunc(func(ctx context.Context, s string) (*result, error) { return nil, nil }, "s"),
+		"eth_list": krpcs.NewRPCFunc(func(p listParams) ([]map[string]*result, error) { return nil, nil }, ""),
+		"ping":     krpcs.NewRPCFunc(func() error { return nil }, ""),
+		"ids":      krpcs.NewRPCFunc(func(s string, p []byte) types.JSONRPCID { return types.JSONRPCID{} }, "string,params"),
+		"ws_only":  krpcs.NewWSRPCFunc(func(wsCtx types.WSRPCContext) {}, ""),
+	}
+	var buf bytes.Buffer
+	require.NoError(t, Generate(&buf, funcMap, Config{Package: "client", PkgPath: "github.com/kooksee/krpc/gen"}))
+	src := buf.String()
+
+	_, err := parser.ParseFile(token.NewFileSet(), "client.go", src, parser.ImportsOnly)
+	require.NoError(t, err, src)
+	for _, want := range []string{
+		"package client\n",
+		"\t\"context\"\n\t\"time\"\n\n\tkrpcc \"github.com/kooksee/krpc/client\"\n\trpctypes \"github.com/kooksee/krpc/types\"\n",
+		"func NewClient(cl krpcc.HTTPClient) *Client {",
+		"func (c *Client) Echo(ctx context.Context, s string) (*result, error) {",
+		"func (c *Client) EthList(ctx context.Context, q string, type2 *string, wait time.Duration) ([]map[string]*result, error) {",
+		"\tif type2 != nil {\n\t\tparams[\"type\"] = *type2\n\t}\n",
+		"func (c *Client) Ids(ctx context.Context, string2 string, params2 []byte) (rpctypes.JSONRPCID, error) {",
+		"\t\t\"params\": params2,\n",
+		"func (c *Client) Ping(ctx context.Context) error {\n\tparams := map[string]interface{}{}\n\treturn c.cl.CallContext(ctx, \"ping\", params, nil)\n}",
+	} {
+		assert.Contains(t, src, want)
+	}
+	assert.NotContains(t, src, "WsOnly")
+}
+
+func TestGenerateErrors(t *testing.T) {
+	noop := krpcs.NewRPCFunc(func() {}, "")
+	tests := []map[string]*krpcs.RPCFunc{
+		{"a_b": noop, "aB": noop},
+		{"_": noop},
+		{"1a": noop},
+		{"f": krpcs.NewRPCFunc(func(p struct{ A struct{ B int } }) {}, "")},
+	}
+	for i, funcMap := range tests {
+		assert.Error(t, Generate(&bytes.Buffer{}, funcMap, Config{Package: "client"}), "#%d", i)
+	}
+	assert.Error(t, Generate(&bytes.Buffer{}, nil, Config{}), "the package is required")
+}
+
+func TestExportedName(t *testing.T) {
+	for method, want := range map[string]string{
+		"echo":            "Echo",
+		"echo_data_bytes": "EchoDataBytes",
+		"eth_getBalance":  "EthGetBalance",
+		"net.peers":       "NetPeers",
+		"é":               "É",
+		"9":               "",
+	} {
+		assert.Equal(t, want, exportedName(method), method)
+	}
+}
@@ -0,0 +1,43 @@
+package krpcs
+
+import (
+	"context"
+
+	types "github.com/kooksee/krpc/types"
+)
+
+type contextKey int
+
+const (
+	requestIDKey contextKey = iota
+	remoteAddrKey
+	methodKey
+)
+
+// withCallInfo returns a copy of ctx carrying the request ID, the remote
+// address and the method name of the call being served.
+func withCallInfo(ctx context.Context, id types.JSONRPCID, remoteAddr, method string) context.Context {
+	ctx = context.WithValue(ctx, requestIDKey, id)
+	ctx = context.WithValue(ctx, remoteAddrKey, remoteAddr)
+	return context.WithValue(ctx, methodKey, method)
+}
+
+// RequestIDFromContext returns the JSON-RPC ID of the request being served.
+// It is empty for notifications and URI requests.
+func RequestIDFromContext(ctx context.Context) (types.JSONRPCID, bool) {
+	id, ok := ctx.Value(requestIDKey).(types.JSONRPCID)
+	return id, ok
+}
+
+// RemoteAddrFromContext returns the address of the client which sent the
+// request being served.
+func RemoteAddrFromContext(ctx context.Context) (string, bool) {
+	addr, ok := ctx.Value(remoteAddrKey).(string)
+	return addr, ok
+}
+
+// MethodFromContext returns the name of the method being called.
+func MethodFromContext(ctx context.Context) (string, bool) {
+	method, ok := ctx.Value(methodKey).(string)
+	return method, ok
+}
@@ -0,0 +1,228 @@
+package krpcs
+
+import (
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+const defaultEventBufferCapacity = 100
+
+// SlowConsumerPolicy decides what happens to a subscriber whose buffer is
+// full when an event is published.
+type SlowConsumerPolicy int
+
+const (
+	// DropEvent drops the events which do not fit into the buffer.
+	DropEvent SlowConsumerPolicy = iota
+	// DisconnectSubscriber cancels the subscription with ErrSlowConsumer.
+	// Websocket subscribers are disconnected.
+	DisconnectSubscriber
+)
+
+var (
+	// ErrAlreadySubscribed is returned when a subscriber subscribes to the same
+	// query twice.
+	ErrAlreadySubscribed = errors.New("already subscribed")
+	// ErrSubscriptionNotFound is returned when a subscriber unsubscribes from a
+	// query it is not subscribed to.
+	ErrSubscriptionNotFound = errors.New("subscription not found")
+	// ErrUnsubscribed is the cancel reason of a subscription removed by
+	// Unsubscribe or UnsubscribeAll.
+	ErrUnsubscribed = errors.New("client unsubscribed")
+	// ErrSlowConsumer is the cancel reason of a subscription that did not keep
+	// up with the published events under the DisconnectSubscriber policy.
+	ErrSlowConsumer = errors.New("subscriber is too slow")
+)
+
+// Event is a single published message.
+type Event struct {
+	Query string
+	Data  interface{}
+}
+
+// Subscription is the buffered stream of events a subscriber receives for a
+// query.
+type Subscription struct {
+	out       chan Event
+	cancelled chan struct{}
+
+	mtx sync.RWMutex
+	err error
+}
+
+// Out returns the channel events are delivered on.
+func (s *Subscription) Out() <-chan Event {
+	return s.out
+}
+
+// Cancelled returns a channel which is closed when the subscription is
+// terminated. Err returns the reason afterwards.
+func (s *Subscription) Cancelled() <-chan struct{} {
+	return s.cancelled
+}
+
+// Err returns nil if the subscription is still active, or the reason it was
+// cancelled.
+func (s *Subscription) Err() error {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+	return s.err
+}
+
+func (s *Subscription) cancel(err error) {
+	s.mtx.Lock()
+	s.err = err
+	s.mtx.Unlock()
+	close(s.cancelled)
+}
+
+// EventBus dispatches published events to the subscribers of the query they
+// are published under. Queries are matched by equality. It is Goroutine-safe.
+type EventBus struct {
+	mtx sync.RWMutex
+	// query -> subscriber -> subscription
+	subscriptions map[string]map[string]*Subscription
+
+	bufferCapacity int
+	policy         SlowConsumerPolicy
+}
+
+// NewEventBus returns a new EventBus. By default each subscription buffers
+// 100 events and events are dropped for slow consumers.
+func NewEventBus(options ...func(*EventBus)) *EventBus {
+	b := &EventBus{
+		subscriptions:  make(map[string]map[string]*Subscription),
+		bufferCapacity: defaultEventBufferCapacity,
+		policy:         DropEvent,
+	}
+	for _, option := range options {
+		option(b)
+	}
+	return b
+}
+
+// BufferCapacity sets the number of events buffered per subscription.
+// It should only be used in the constructor - not Goroutine-safe.
+func BufferCapacity(cap int) func(*EventBus) {
+	return func(b *EventBus) {
+		b.bufferCapacity = cap
+	}
+}
+
+// OnSlowConsumer sets the policy applied when a subscription's buffer is full.
+// It should only be used in the constructor - not Goroutine-safe.
+func OnSlowConsumer(policy SlowConsumerPolicy) func(*EventBus) {
+	return func(b *EventBus) {
+		b.policy = policy
+	}
+}
+
+// Subscribe subscribes the subscriber to the events published under query.
+func (b *EventBus) Subscribe(subscriber, query string) (*Subscription, error) {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	subs, ok := b.subscriptions[query]
+	if !ok {
+		subs = make(map[string]*Subscription)
+		b.subscriptions[query] = subs
+	}
+	if _, ok := subs[subscriber]; ok {
+		return nil, ErrAlreadySubscribed
+	}
+	sub := &Subscription{
+		out:       make(chan Event, b.bufferCapacity),
+		cancelled: make(chan struct{}),
+	}
+	subs[subscriber] = sub
+	return sub, nil
+}
+
+// Unsubscribe cancels the subscriber's subscription to query.
+func (b *EventBus) Unsubscribe(subscriber, query string) error {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	if !b.remove(subscriber, query, ErrUnsubscribed) {
+		return ErrSubscriptionNotFound
+	}
+	return nil
+}
+
+// UnsubscribeAll cancels all of the subscriber's subscriptions.
+func (b *EventBus) UnsubscribeAll(subscriber string) error {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	found := false
+	for query := range b.subscriptions {
+		if b.remove(subscriber, query, ErrUnsubscribed) {
+			found = true
+		}
+	}
+	if !found {
+		return ErrSubscriptionNotFound
+	}
+	return nil
+}
+
+// NumSubscribers returns the number of subscribers to query.
+func (b *EventBus) NumSubscribers(query string) int {
+	b.mtx.RLock()
+	defer b.mtx.RUnlock()
+	return len(b.subscriptions[query])
+}
+
+// Publish delivers data to every subscriber of query. It never blocks; full
+// subscriptions are handled according to the slow consumer policy.
+func (b *EventBus) Publish(query string, data interface{}) {
+	event := Event{Query: query, Data: data}
+
+	slow := make(map[string]*Subscription)
+	b.mtx.RLock()
+	for subscriber, sub := range b.subscriptions[query] {
+		select {
+		case sub.out <- event:
+		default:
+			if b.policy == DisconnectSubscriber {
+				slow[subscriber] = sub
+			} else {
+				logger.Debug().Str("subscriber", subscriber).Str("query", query).Msg("Subscription buffer is full, dropping event")
+			}
+		}
+	}
+	b.mtx.RUnlock()
+
+	if len(slow) == 0 {
+		return
+	}
+	b.mtx.Lock()
+	for subscriber, sub := range slow {
+		// the subscriber may have resubscribed in the meantime
+		if b.subscriptions[query][subscriber] != sub {
+			continue
+		}
+		logger.Info().Str("subscriber", subscriber).Str("query", query).Msg("Cancelling subscription of slow consumer")
+		b.remove(subscriber, query, ErrSlowConsumer)
+	}
+	b.mtx.Unlock()
+}
+
+// remove cancels and removes a subscription. b.mtx must be held.
+func (b *EventBus) remove(subscriber, query string, reason error) bool {
+	subs, ok := b.subscriptions[query]
+	if !ok {
+		return false
+	}
+	sub, ok := subs[subscriber]
+	if !ok {
+		return false
+	}
+	sub.cancel(reason)
+	delete(subs, subscriber)
+	if len(subs) == 0 {
+		delete(b.subscriptions, query)
+	}
+	return true
+}
@@ -0,0 +1,66 @@
+package krpcs
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEventBusPublish(t *testing.T) {
+	b := NewEventBus()
+	sub, err := b.Subscribe("client", "NewBlock")
+	require.NoError(t, err)
+
+	_, err = b.Subscribe("client", "NewBlock")
+	assert.Equal(t, ErrAlreadySubscribed, err)
+
+	b.Publish("NewBlock", 1)
+	b.Publish("Other", 2)
+	b.Publish("NewBlock", 3)
+
+	assert.Equal(t, Event{Query: "NewBlock", Data: 1}, <-sub.Out())
+	assert.Equal(t, Event{Query: "NewBlock", Data: 3}, <-sub.Out())
+	assert.Len(t, sub.Out(), 0)
+}
+
+func TestEventBusUnsubscribe(t *testing.T) {
+	b := NewEventBus()
+	sub1, err := b.Subscribe("client", "a")
+	require.NoError(t, err)
+	sub2, err := b.Subscribe("client", "b")
+	require.NoError(t, err)
+	assert.Equal(t, 1, b.NumSubscribers("a"))
+
+	require.NoError(t, b.Unsubscribe("client", "a"))
+	<-sub1.Cancelled()
+	assert.Equal(t, ErrUnsubscribed, sub1.Err())
+	assert.Nil(t, sub2.Err())
+	assert.Equal(t, ErrSubscriptionNotFound, b.Unsubscribe("client", "a"))
+
+	require.NoError(t, b.UnsubscribeAll("client"))
+	<-sub2.Cancelled()
+	assert.Equal(t, 0, b.NumSubscribers("b"))
+	assert.Equal(t, ErrSubscriptionNotFound, b.UnsubscribeAll("client"))
+}
+
+func TestEventBusSlowConsumer(t *testing.T) {
+	// drop
+	b := NewEventBus(BufferCapacity(1))
+	sub, err := b.Subscribe("client", "a")
+	require.NoError(t, err)
+	b.Publish("a", 1)
+	b.Publish("a", 2)
+	assert.Equal(t, 1, (<-sub.Out()).Data)
+	assert.Nil(t, sub.Err())
+
+	// disconnect
+	b = NewEventBus(BufferCapacity(1), OnSlowConsumer(DisconnectSubscriber))
+	sub, err = b.Subscribe("client", "a")
+	require.NoError(t, err)
+	b.Publish("a", 1)
+	b.Publish("a", 2)
+	<-sub.Cancelled()
+	assert.Equal(t, ErrSlowConsumer, sub.Err())
+	assert.Equal(t, 0, b.NumSubscribers("a"))
+}
@@ -2,32 +2,85 @@ package krpcs
 
 import (
 	"bytes"
+	"context"
 	"encoding/hex"
 	"encoding/json"
+	stderrors "errors"
 	"fmt"
 	"github.com/pkg/errors"
 	"io/ioutil"
 	"net/http"
 	"reflect"
+	"runtime/debug"
 	"sort"
 	"strings"
+	"sync"
+	"time"
 
-	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
 	types "github.com/kooksee/krpc/types"
+	"github.com/rs/zerolog"
 	"github.com/tendermint/go-amino"
 )
 
 // RegisterRPCFuncs adds a route for each function in the funcMap, as well as general jsonrpc and websocket handlers for all functions.
 // "result" is the interface on which the result objects are registered, and is popualted with every RPCResponse
 func RegisterRPCFuncs(mux *http.ServeMux, funcMap map[string]*RPCFunc, cdc *amino.Codec) {
+	RegisterRPCFuncsWithConfig(mux, funcMap, cdc, DefaultConfig())
+}
+
+// RegisterRPCFuncsWithConfig is like RegisterRPCFuncs, but the handlers obey
+// the limits set in config. Unless config.DisableDiscovery is set, the OpenRPC
+// document of funcMap is served by the DiscoverMethod and on OpenRPCPath.
+func RegisterRPCFuncsWithConfig(mux *http.ServeMux, funcMap map[string]*RPCFunc, cdc *amino.Codec, config Config) {
+
+	interceptor := ChainInterceptors(config.Interceptors...)
+
+	if !config.DisableDiscovery {
+		d := newDiscovery(funcMap, cdc, config.OpenRPCInfo)
+		funcMap = d.withDiscovery(funcMap)
+		mux.Handle(OpenRPCPath, d)
+	}
 
 	// HTTP endpoints
 	for funcName, rpcFunc := range funcMap {
-		mux.HandleFunc("/"+funcName, makeHTTPHandler(rpcFunc, cdc))
+		mux.HandleFunc("/"+funcName, makeHTTPHandler(rpcFunc, cdc, interceptor))
 	}
 
 	// JSONRPC endpoints
-	mux.HandleFunc("/", handleInvalidJSONRPCPaths(makeJSONRPCHandler(funcMap, cdc)))
+	mux.HandleFunc("/", handleInvalidJSONRPCPaths(makeJSONRPCHandler(funcMap, cdc, config)))
+}
+
+// DefaultWSPath is the path RegisterWSFuncs mounts the websocket handler on
+// when no path is given.
+const DefaultWSPath = "/websocket"
+
+// RegisterWSFuncs mounts a websocket handler for all functions in the funcMap
+// (websocket-only and regular ones) on path, or DefaultWSPath if path is empty.
+// It returns the WebsocketManager serving the connections.
+func RegisterWSFuncs(mux *http.ServeMux, path string, funcMap map[string]*RPCFunc, cdc *amino.Codec, wsConnOptions ...func(*wsConnection)) *WebsocketManager {
+	return RegisterWSFuncsWithConfig(mux, path, funcMap, cdc, DefaultConfig(), wsConnOptions...)
+}
+
+// RegisterWSFuncsWithConfig is like RegisterWSFuncs, but the connections obey
+// the websocket limits and interceptors set in config. wsConnOptions are
+// applied after them. Unless config.DisableDiscovery is set, the
+// DiscoverMethod returns the OpenRPC document of funcMap.
+func RegisterWSFuncsWithConfig(mux *http.ServeMux, path string, funcMap map[string]*RPCFunc, cdc *amino.Codec, config Config, wsConnOptions ...func(*wsConnection)) *WebsocketManager {
+	if path == "" {
+		path = DefaultWSPath
+	}
+	if !config.DisableDiscovery {
+		funcMap = newDiscovery(funcMap, cdc, config.OpenRPCInfo).withDiscovery(funcMap)
+	}
+	wm := NewWebsocketManager(funcMap, cdc, append(config.wsConnOptions(), wsConnOptions...)...)
+	wm.ReadBufferSize = config.WSReadBufferSize
+	wm.WriteBufferSize = config.WSWriteBufferSize
+	if config.WSCheckOrigin != nil {
+		wm.CheckOrigin = config.WSCheckOrigin
+	}
+	mux.HandleFunc(path, wm.WebsocketHandler)
+	return wm
 }
 
 //-------------------------------------
@@ -39,27 +92,150 @@ type RPCFunc struct {
 	args     []reflect.Type // type of each function arg
 	returns  []reflect.Type // type of each return arg
 	argNames []string       // name of each argument
+	params   []paramSpec    // declaration of each named argument
 	ws       bool           // websocket only
+	ctx      bool           // takes a context.Context as its first parameter
 }
 
 // NewRPCFunc wraps a function for introspection.
-// f is the function, args are comma separated argument names
+// f is the function, args are comma separated argument names. A name may be
+// followed by "!" if the argument is required, "?" if it is optional, or
+// "=value" if it is optional with a default value, given like in URI
+// requests (e.g. "limit=20"). Other arguments get their zero value if they
+// are omitted from named params, but must be given in positional params.
+// If f takes a context.Context as its first parameter, it is passed the
+// context of the request, which is not named in args.
+// If args is empty and f takes a single params struct (a struct or pointer to
+// a struct with exported fields, which is not a json.Unmarshaler), e.g. func(context.Context, *EchoParams) (*Result, error), the
+// fields of the struct are the named arguments, see FuncMap.RegisterService.
+// Named params then map to the fields by their json tags, positional params
+// to the fields in order, and URI params are parsed into the fields.
+// It panics if f or args are invalid, see TryNewRPCFunc.
 func NewRPCFunc(f interface{}, args string) *RPCFunc {
+	rpcFunc, err := TryNewRPCFunc(f, args)
+	if err != nil {
+		panic(fmt.Sprintf("NewRPCFunc: %v", err))
+	}
+	return rpcFunc
+}
+
+// NewWSRPCFunc wraps a function for introspection and use in the websockets.
+// f must take a types.WSRPCContext as its first parameter (after an optional
+// context.Context), which is not named in args.
+// It panics if f or args are invalid, see TryNewWSRPCFunc.
+func NewWSRPCFunc(f interface{}, args string) *RPCFunc {
+	rpcFunc, err := TryNewWSRPCFunc(f, args)
+	if err != nil {
+		panic(fmt.Sprintf("NewWSRPCFunc: %v", err))
+	}
+	return rpcFunc
+}
+
+// TryNewRPCFunc is like NewRPCFunc, but returns an error if f is not a
+// function with a valid return signature, or args does not name each of its
+// parameters (apart from the context.Context) exactly once, or a default value
+// is invalid.
+func TryNewRPCFunc(f interface{}, args string) (*RPCFunc, error) {
 	return newRPCFunc(f, args, false)
 }
 
-func newRPCFunc(f interface{}, args string, ws bool) *RPCFunc {
-	var argNames []string
-	if args != "" {
-		argNames = strings.Split(args, ",")
+// TryNewWSRPCFunc is like NewWSRPCFunc, but returns an error like
+// TryNewRPCFunc, or if f does not take a types.WSRPCContext.
+func TryNewWSRPCFunc(f interface{}, args string) (*RPCFunc, error) {
+	return newRPCFunc(f, args, true)
+}
+
+var (
+	contextType         = reflect.TypeOf((*context.Context)(nil)).Elem()
+	wsRPCContextType    = reflect.TypeOf(types.WSRPCContext{})
+	errorType           = reflect.TypeOf((*error)(nil)).Elem()
+	jsonUnmarshalerType = reflect.TypeOf((*json.Unmarshaler)(nil)).Elem()
+)
+
+// checkReturns returns an error unless t is a function returning
+// (result, error), only a result, only an error or nothing.
+func checkReturns(t reflect.Type) error {
+	switch t.NumOut() {
+	case 0, 1:
+		return nil
+	case 2:
+		if t.Out(1) == errorType {
+			return nil
+		}
 	}
-	return &RPCFunc{
-		f:        reflect.ValueOf(f),
-		args:     funcArgTypes(f),
-		returns:  funcReturnTypes(f),
-		argNames: argNames,
-		ws:       ws,
+	return errors.Errorf("%v must return (result, error), a result, an error or nothing", t)
+}
+
+func newRPCFunc(f interface{}, args string, ws bool) (*RPCFunc, error) {
+	argNames, params, err := parseParams(args)
+	if err != nil {
+		return nil, err
 	}
+	if t := reflect.TypeOf(f); len(argNames) == 0 && t != nil && t.Kind() == reflect.Func {
+		if offset := leadingParams(t); t.NumIn() == offset+1 && structType(t.In(offset)) != nil {
+			return newStructRPCFunc(reflect.ValueOf(f), offset, ws)
+		}
+	}
+	return newRPCFuncWithParams(f, argNames, params, ws)
+}
+
+// newRPCFuncWithParams is like newRPCFunc, with the declarations of args
+// already parsed.
+func newRPCFuncWithParams(f interface{}, argNames []string, params []paramSpec, ws bool) (*RPCFunc, error) {
+	t := reflect.TypeOf(f)
+	if t == nil || t.Kind() != reflect.Func {
+		return nil, errors.Errorf("%v is not a function", t)
+	}
+	if err := checkReturns(t); err != nil {
+		return nil, err
+	}
+	argTypes := funcArgTypes(f)
+	rpcFunc := &RPCFunc{
+		f:       reflect.ValueOf(f),
+		args:    argTypes,
+		returns: funcReturnTypes(f),
+		ws:      ws,
+		ctx:     len(argTypes) > 0 && argTypes[0] == contextType,
+	}
+	if ws {
+		i := 0
+		if rpcFunc.ctx {
+			i = 1
+		}
+		if len(argTypes) <= i || argTypes[i] != wsRPCContextType {
+			return nil, errors.Errorf("%v must take types.WSRPCContext as its first parameter", t)
+		}
+	}
+	if n := len(argTypes) - rpcFunc.argsOffset(); n != len(argNames) {
+		return nil, errors.Errorf("%v takes %d parameters, but %d are named (%q)", t, n, len(argNames), strings.Join(argNames, ","))
+	}
+	rpcFunc.argNames = argNames
+	rpcFunc.params = params
+	if err := rpcFunc.checkDefaults(); err != nil {
+		return nil, err
+	}
+	return rpcFunc, nil
+}
+
+// argsOffset is the number of leading parameters which are not named in
+// argNames: the context.Context and the types.WSRPCContext, if taken.
+func (f *RPCFunc) argsOffset() int {
+	offset := 0
+	if f.ctx {
+		offset++
+	}
+	if f.ws {
+		offset++
+	}
+	return offset
+}
+
+// call invokes the function, passing ctx first if it takes a context.
+func (f *RPCFunc) call(ctx context.Context, args []reflect.Value) []reflect.Value {
+	if f.ctx {
+		args = append([]reflect.Value{reflect.ValueOf(ctx)}, args...)
+	}
+	return f.f.Call(args)
 }
 
 // return a function's argument types
@@ -89,11 +265,33 @@ func funcReturnTypes(f interface{}) []reflect.Type {
 // rpc.json
 
 // jsonrpc calls grab the given method's function info and runs reflect.Call
-func makeJSONRPCHandler(funcMap map[string]*RPCFunc, cdc *amino.Codec) http.HandlerFunc {
+func makeJSONRPCHandler(funcMap map[string]*RPCFunc, cdc *amino.Codec, config Config) http.HandlerFunc {
+	interceptor := ChainInterceptors(config.Interceptors...)
+
+	// Notifications run in the background on at most MaxNotificationWorkers
+	// goroutines, which Server.Shutdown waits for, or before responding if it
+	// is 0.
+	var workers chan struct{}
+	if config.MaxNotificationWorkers > 0 {
+		workers = make(chan struct{}, config.MaxNotificationWorkers)
+	}
+	notify := func(r *http.Request, request types.RPCRequest) {
+		if workers == nil {
+			executeJSONRPCNotification(r.Context(), r, funcMap, cdc, interceptor, request)
+			return
+		}
+		workers <- struct{}{}
+		goBackground(r.Context(), func() {
+			defer func() { <-workers }()
+			// the request context is cancelled once the response is written
+			executeJSONRPCNotification(context.Background(), r, funcMap, cdc, interceptor, request)
+		})
+	}
+
 	return func(w http.ResponseWriter, r *http.Request) {
 		b, err := ioutil.ReadAll(r.Body)
 		if err != nil {
-			WriteRPCResponseHTTP(w, types.RPCInvalidRequestError(uuid.New().String(), errors.Wrap(err, "Error reading request body")))
+			WriteRPCResponseHTTP(w, types.RPCInvalidRequestError(types.NullID(), errors.Wrap(err, "Error reading request body")))
 			return
 		}
 		// if its an empty request (like from a browser),
@@ -103,45 +301,152 @@ func makeJSONRPCHandler(funcMap map[string]*RPCFunc, cdc *amino.Codec) http.Hand
 			return
 		}
 
+		// A batch is an array of requests.
+		if trimmed := bytes.TrimLeft(b, " \t\r\n"); len(trimmed) > 0 && trimmed[0] == '[' {
+			handleJSONRPCBatch(w, r, funcMap, cdc, interceptor, config, notify, b)
+			return
+		}
+
 		var request types.RPCRequest
 		err = json.Unmarshal(b, &request)
 		if err != nil {
-			WriteRPCResponseHTTP(w, types.RPCParseError(uuid.New().String(), errors.Wrap(err, "Error unmarshalling request")))
+			WriteRPCResponseHTTP(w, types.RPCParseError(types.NullID(), errors.Wrap(err, "Error unmarshalling request")))
 			return
 		}
 		// A Notification is a Request object without an "id" member.
 		// The Server MUST NOT reply to a Notification, including those that are within a batch request.
-		if request.ID == "" {
-			request.ID = uuid.New().String()
-			logger.Debug().Msg("HTTPJSONRPC received a notification, skipping... (please send a non-empty ID if you want to call a method)")
+		if request.ID.IsEmpty() {
+			notify(r, request)
+			w.WriteHeader(http.StatusNoContent)
 			return
 		}
-		if len(r.URL.Path) > 1 {
-			WriteRPCResponseHTTP(w, types.RPCInvalidRequestError(request.ID, errors.Errorf("Path %s is invalid", r.URL.Path)))
+		WriteRPCResponseHTTP(w, executeJSONRPCRequestSafe(r.Context(), r, funcMap, cdc, interceptor, request))
+	}
+}
+
+// handleJSONRPCBatch executes every request of a batch, using up to
+// config.MaxBatchWorkers goroutines, and writes the responses as an array.
+// Notifications are passed to notify and get no response; if the batch
+// consists of notifications only, nothing is written.
+func handleJSONRPCBatch(w http.ResponseWriter, r *http.Request, funcMap map[string]*RPCFunc, cdc *amino.Codec, interceptor Interceptor, config Config, notify func(*http.Request, types.RPCRequest), b []byte) {
+	var batch []json.RawMessage
+	if err := json.Unmarshal(b, &batch); err != nil {
+		WriteRPCResponseHTTP(w, types.RPCParseError(types.NullID(), errors.Wrap(err, "Error unmarshalling request")))
+		return
+	}
+	if len(batch) == 0 {
+		WriteRPCResponseHTTP(w, types.RPCInvalidRequestError(types.NullID(), errors.New("Empty batch")))
+		return
+	}
+	if config.MaxBatchSize > 0 && len(batch) > config.MaxBatchSize {
+		WriteRPCResponseHTTP(w, types.RPCInvalidRequestError(types.NullID(), errors.Errorf("Batch of %d requests exceeds the maximum of %d", len(batch), config.MaxBatchSize)))
+		return
+	}
+
+	// nil marks a notification, which gets no response.
+	responses := make([]*types.RPCResponse, len(batch))
+	execute := func(i int) {
+		var request types.RPCRequest
+		if err := json.Unmarshal(batch[i], &request); err != nil {
+			response := types.RPCInvalidRequestError(types.NullID(), errors.Wrap(err, "Error unmarshalling request"))
+			responses[i] = &response
 			return
 		}
-		rpcFunc := funcMap[request.Method]
-		if rpcFunc == nil || rpcFunc.ws {
-			WriteRPCResponseHTTP(w, types.RPCMethodNotFoundError(request.ID))
+		if request.ID.IsEmpty() {
+			notify(r, request)
 			return
 		}
-		var args []reflect.Value
-		if len(request.Params) > 0 {
-			args, err = jsonParamsToArgsRPC(rpcFunc, cdc, request.Params)
-			if err != nil {
-				WriteRPCResponseHTTP(w, types.RPCInvalidParamsError(request.ID, errors.Wrap(err, "Error converting json params to arguments")))
-				return
-			}
+		response := executeJSONRPCRequestSafe(r.Context(), r, funcMap, cdc, interceptor, request)
+		responses[i] = &response
+	}
+
+	workers := config.MaxBatchWorkers
+	if workers <= 1 {
+		for i := range batch {
+			execute(i)
 		}
-		returns := rpcFunc.f.Call(args)
-		logger.Info().Str("method", request.Method).Interface("returns", returns).Interface("args", args).Msg("HTTPJSONRPC")
-		result, err := unreflectResult(returns)
-		if err != nil {
-			WriteRPCResponseHTTP(w, types.RPCInternalError(request.ID, err))
-			return
+	} else {
+		var wg sync.WaitGroup
+		sem := make(chan struct{}, workers)
+		for i := range batch {
+			wg.Add(1)
+			sem <- struct{}{}
+			go func(i int) {
+				defer func() {
+					<-sem
+					wg.Done()
+				}()
+				execute(i)
+			}(i)
 		}
-		WriteRPCResponseHTTP(w, types.NewRPCSuccessResponse(cdc, request.ID, result))
+		wg.Wait()
 	}
+
+	var res []types.RPCResponse
+	for _, response := range responses {
+		if response != nil {
+			res = append(res, *response)
+		}
+	}
+	if len(res) == 0 {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	WriteRPCResponseArrayHTTP(w, res)
+}
+
+// executeJSONRPCRequest runs a single (non notification) request and returns
+// its response.
+func executeJSONRPCRequest(ctx context.Context, r *http.Request, funcMap map[string]*RPCFunc, cdc *amino.Codec, interceptor Interceptor, request types.RPCRequest) types.RPCResponse {
+	if len(r.URL.Path) > 1 {
+		return types.RPCInvalidRequestError(request.ID, errors.Errorf("Path %s is invalid", r.URL.Path))
+	}
+	rpcFunc := funcMap[request.Method]
+	if rpcFunc == nil || rpcFunc.ws {
+		return types.RPCMethodNotFoundError(request.ID)
+	}
+	// "params" may be omitted, which is treated the same as null.
+	params := request.Params
+	if len(params) == 0 {
+		params = json.RawMessage("null")
+	}
+	args, err := jsonParamsToArgsRPC(rpcFunc, cdc, params)
+	if err != nil {
+		return invalidParamsResponse(request.ID, errors.Wrap(err, "Error converting json params to arguments"))
+	}
+	info := newCallInfo(rpcFunc, TransportJSONRPC, request.ID, r.RemoteAddr, request.Method, r, args)
+	result, err := rpcFunc.invoke(ctx, info, args, interceptor)
+	logger.Info().Str("method", request.Method).Interface("result", result).Interface("args", args).Msg("HTTPJSONRPC")
+	if err != nil {
+		return errorResponse(cdc, request.ID, err)
+	}
+	return types.NewRPCSuccessResponse(cdc, request.ID, result)
+}
+
+// executeJSONRPCNotification runs a notification. Its response is dropped,
+// errors are only logged.
+func executeJSONRPCNotification(ctx context.Context, r *http.Request, funcMap map[string]*RPCFunc, cdc *amino.Codec, interceptor Interceptor, request types.RPCRequest) {
+	response := executeJSONRPCRequestSafe(ctx, r, funcMap, cdc, interceptor, request)
+	if response.Error != nil {
+		logger.Debug().Str("method", request.Method).Str("err", response.Error.Error()).Msg("HTTPJSONRPC notification failed")
+	}
+}
+
+// executeJSONRPCRequestSafe is executeJSONRPCRequest, but a panic in the
+// handler is turned into an error response for this request instead of
+// failing the whole batch.
+func executeJSONRPCRequestSafe(ctx context.Context, r *http.Request, funcMap map[string]*RPCFunc, cdc *amino.Codec, interceptor Interceptor, request types.RPCRequest) (response types.RPCResponse) {
+	defer func() {
+		if e := recover(); e != nil {
+			if res, ok := e.(types.RPCResponse); ok {
+				response = res
+				return
+			}
+			logger.Error().Str("stack", string(debug.Stack())).Msg("Panic in RPC HTTP handler")
+			response = types.RPCInternalError(request.ID, errors.Errorf("%v", e))
+		}
+	}()
+	return executeJSONRPCRequest(ctx, r, funcMap, cdc, interceptor, request)
 }
 
 func handleInvalidJSONRPCPaths(next http.HandlerFunc) http.HandlerFunc {
@@ -159,31 +464,43 @@ func handleInvalidJSONRPCPaths(next http.HandlerFunc) http.HandlerFunc {
 
 func mapParamsToArgs(rpcFunc *RPCFunc, cdc *amino.Codec, params map[string]json.RawMessage, argsOffset int) ([]reflect.Value, error) {
 	values := make([]reflect.Value, len(rpcFunc.argNames))
+	missing := &invalidFieldsError{}
 	for i, argName := range rpcFunc.argNames {
 		argType := rpcFunc.args[i+argsOffset]
 
-		if p, ok := params[argName]; ok && p != nil && len(p) > 0 {
+		if p, ok := params[argName]; ok && len(p) > 0 && string(p) != "null" {
 			val := reflect.New(argType)
 			err := cdc.UnmarshalJSON(p, val.Interface())
 			if err != nil {
 				return nil, err
 			}
 			values[i] = val.Elem()
-		} else { // use default for that type
-			values[i] = reflect.Zero(argType)
+		} else { // use the default of the parameter
+			val, err := rpcFunc.missingArg(cdc, i)
+			if err == errMissingParam {
+				missing.add(argName, err)
+				continue
+			} else if err != nil {
+				return nil, err
+			}
+			values[i] = val
 		}
 	}
+	if len(missing.fields) > 0 {
+		return nil, missing
+	}
 
 	return values, nil
 }
 
 func arrayParamsToArgs(rpcFunc *RPCFunc, cdc *amino.Codec, params []json.RawMessage, argsOffset int) ([]reflect.Value, error) {
-	if len(rpcFunc.argNames) != len(params) {
+	// trailing optional parameters may be left out
+	if len(params) > len(rpcFunc.argNames) || !rpcFunc.optionalFrom(len(params)) {
 		return nil, errors.Errorf("Expected %v parameters (%v), got %v (%v)",
 			len(rpcFunc.argNames), rpcFunc.argNames, len(params), params)
 	}
 
-	values := make([]reflect.Value, len(params))
+	values := make([]reflect.Value, len(rpcFunc.argNames))
 	for i, p := range params {
 		argType := rpcFunc.args[i+argsOffset]
 		val := reflect.New(argType)
@@ -193,6 +510,13 @@ func arrayParamsToArgs(rpcFunc *RPCFunc, cdc *amino.Codec, params []json.RawMess
 		}
 		values[i] = val.Elem()
 	}
+	for i := len(params); i < len(values); i++ {
+		val, err := rpcFunc.defaultArg(cdc, i)
+		if err != nil {
+			return nil, err
+		}
+		values[i] = val
+	}
 	return values, nil
 }
 
@@ -225,15 +549,25 @@ func jsonParamsToArgs(rpcFunc *RPCFunc, cdc *amino.Codec, raw []byte, argsOffset
 
 // Convert a []interface{} OR a map[string]interface{} to properly typed values
 func jsonParamsToArgsRPC(rpcFunc *RPCFunc, cdc *amino.Codec, params json.RawMessage) ([]reflect.Value, error) {
-	return jsonParamsToArgs(rpcFunc, cdc, params, 0)
+	values, err := jsonParamsToArgs(rpcFunc, cdc, params, rpcFunc.argsOffset())
+	if err != nil {
+		return nil, err
+	}
+	if err := rpcFunc.validateArgs(values); err != nil {
+		return nil, err
+	}
+	return values, nil
 }
 
 // Same as above, but with the first param the websocket connection
 func jsonParamsToArgsWS(rpcFunc *RPCFunc, cdc *amino.Codec, params json.RawMessage, wsCtx types.WSRPCContext) ([]reflect.Value, error) {
-	values, err := jsonParamsToArgs(rpcFunc, cdc, params, 1)
+	values, err := jsonParamsToArgs(rpcFunc, cdc, params, rpcFunc.argsOffset())
 	if err != nil {
 		return nil, err
 	}
+	if err := rpcFunc.validateArgs(values); err != nil {
+		return nil, err
+	}
 	return append([]reflect.Value{reflect.ValueOf(wsCtx)}, values...), nil
 }
 
@@ -242,11 +576,11 @@ func jsonParamsToArgsWS(rpcFunc *RPCFunc, cdc *amino.Codec, params json.RawMessa
 // rpc.http
 
 // convert from a function name to the http handler
-func makeHTTPHandler(rpcFunc *RPCFunc, cdc *amino.Codec) func(http.ResponseWriter, *http.Request) {
+func makeHTTPHandler(rpcFunc *RPCFunc, cdc *amino.Codec, interceptor Interceptor) func(http.ResponseWriter, *http.Request) {
 	// Exception for websocket endpoints
 	if rpcFunc.ws {
 		return func(w http.ResponseWriter, r *http.Request) {
-			WriteRPCResponseHTTP(w, types.RPCMethodNotFoundError(""))
+			WriteRPCResponseHTTP(w, types.RPCMethodNotFoundError(types.StringID("")))
 		}
 	}
 	// All other endpoints
@@ -254,35 +588,43 @@ func makeHTTPHandler(rpcFunc *RPCFunc, cdc *amino.Codec) func(http.ResponseWrite
 		logger.Debug().Interface("req", r).Msg("HTTP HANDLER")
 		args, err := httpParamsToArgs(rpcFunc, cdc, r)
 		if err != nil {
-			WriteRPCResponseHTTP(w, types.RPCInvalidParamsError("", errors.Wrap(err, "Error converting http params to arguments")))
+			WriteRPCResponseHTTP(w, invalidParamsResponse(types.StringID(""), errors.Wrap(err, "Error converting http params to arguments")))
 			return
 		}
 
-		returns := rpcFunc.f.Call(args)
-		logger.Info().Str("method", r.URL.Path).Interface("args", args).Interface("returns", returns).Msg("HTTPRestRPC")
-		result, err := unreflectResult(returns)
+		info := newCallInfo(rpcFunc, TransportURI, types.JSONRPCID{}, r.RemoteAddr, strings.TrimPrefix(r.URL.Path, "/"), r, args)
+		result, err := rpcFunc.invoke(r.Context(), info, args, interceptor)
+		logger.Info().Str("method", r.URL.Path).Interface("args", args).Interface("result", result).Msg("HTTPRestRPC")
 		if err != nil {
-			WriteRPCResponseHTTP(w, types.RPCInternalError("", err))
+			WriteRPCResponseHTTP(w, errorResponse(cdc, types.StringID(""), err))
 			return
 		}
-		WriteRPCResponseHTTP(w, types.NewRPCSuccessResponse(cdc, "", result))
+		WriteRPCResponseHTTP(w, types.NewRPCSuccessResponse(cdc, types.StringID(""), result))
 	}
 }
 
 // Covert an http query to a list of properly typed values.
 // To be properly decoded the arg must be a concrete type from tendermint (if its an interface).
 func httpParamsToArgs(rpcFunc *RPCFunc, cdc *amino.Codec, r *http.Request) ([]reflect.Value, error) {
-	values := make([]reflect.Value, len(rpcFunc.args))
+	values := make([]reflect.Value, len(rpcFunc.argNames))
+	missing := &invalidFieldsError{}
 
 	for i, name := range rpcFunc.argNames {
-		argType := rpcFunc.args[i]
-
-		values[i] = reflect.Zero(argType) // set default for that type
+		argType := rpcFunc.args[i+rpcFunc.argsOffset()]
 
 		arg := GetParam(r, name)
 		// log.Notice("param to arg", "argType", argType, "name", name, "arg", arg)
 
 		if "" == arg {
+			// use the default of the parameter
+			val, err := rpcFunc.missingArg(cdc, i)
+			if err == errMissingParam {
+				missing.add(name, err)
+				continue
+			} else if err != nil {
+				return nil, err
+			}
+			values[i] = val
 			continue
 		}
 
@@ -300,6 +642,12 @@ func httpParamsToArgs(rpcFunc *RPCFunc, cdc *amino.Codec, r *http.Request) ([]re
 			return nil, err
 		}
 	}
+	if len(missing.fields) > 0 {
+		return nil, missing
+	}
+	if err := rpcFunc.validateArgs(values); err != nil {
+		return nil, err
+	}
 
 	return values, nil
 }
@@ -393,13 +741,585 @@ func _nonJSONStringToArg(cdc *amino.Codec, rt reflect.Type, arg string) (reflect
 //-----------------------------------------------------------------------------
 // rpc.websocket
 
-// NOTE: assume returns is result struct and error. If error is not nil, return it
+const (
+	defaultWSWriteChanCapacity = 1000
+	defaultWSWriteWait         = 10 * time.Second
+	defaultWSReadWait          = 30 * time.Second
+	defaultWSPingPeriod        = (defaultWSReadWait * 9) / 10
+)
+
+// WebsocketManager provides a WS handler for incoming connections and passes a
+// map of functions along with any additional params to new connections.
+// NOTE: The websocket path is defined externally, e.g. by mounting
+// WebsocketHandler on a mux.
+type WebsocketManager struct {
+	websocket.Upgrader
+
+	funcMap       map[string]*RPCFunc
+	cdc           *amino.Codec
+	wsConnOptions []func(*wsConnection)
+
+	mtx    sync.Mutex
+	conns  map[*wsConnection]struct{}
+	wg     sync.WaitGroup
+	closed bool
+}
+
+// NewWebsocketManager returns a new WebsocketManager that passes a map of
+// functions and connection options to new WS connections.
+// The upgrader accepts requests from any origin, like the HTTP handlers which
+// don't check it either; set Upgrader.CheckOrigin (or Config.WSCheckOrigin)
+// to restrict browsers to trusted origins.
+func NewWebsocketManager(funcMap map[string]*RPCFunc, cdc *amino.Codec, wsConnOptions ...func(*wsConnection)) *WebsocketManager {
+	return &WebsocketManager{
+		funcMap: funcMap,
+		cdc:     cdc,
+		Upgrader: websocket.Upgrader{
+			CheckOrigin: func(r *http.Request) bool {
+				return true
+			},
+		},
+		wsConnOptions: wsConnOptions,
+		conns:         make(map[*wsConnection]struct{}),
+	}
+}
+
+// WebsocketHandler upgrades the request/response (via http.Hijack) and starts
+// the wsConnection.
+func (wm *WebsocketManager) WebsocketHandler(w http.ResponseWriter, r *http.Request) {
+	wsConn, err := wm.Upgrade(w, r, nil)
+	if err != nil {
+		// Upgrade has already replied with an HTTP error.
+		logger.Error().Err(err).Msg("Failed to upgrade to websocket connection")
+		return
+	}
+
+	// register connection
+	con := NewWSConnection(wsConn, wm.funcMap, wm.cdc, wm.wsConnOptions...)
+	con.httpRequest = r
+	if !wm.add(con) {
+		con.closeGracefully(websocket.CloseGoingAway, "server is shutting down")
+		return
+	}
+	defer wm.remove(con)
+	logger.Info().Str("remote", con.remoteAddr).Msg("New websocket connection")
+	con.Start() // Blocking
+}
+
+// Shutdown closes all connections with a close frame and rejects new ones. It
+// waits until the connections are closed or ctx is done.
+func (wm *WebsocketManager) Shutdown(ctx context.Context) error {
+	wm.mtx.Lock()
+	wm.closed = true
+	conns := make([]*wsConnection, 0, len(wm.conns))
+	for con := range wm.conns {
+		conns = append(conns, con)
+	}
+	wm.mtx.Unlock()
+
+	for _, con := range conns {
+		con.closeGracefully(websocket.CloseGoingAway, "server is shutting down")
+	}
+
+	done := make(chan struct{})
+	go func() {
+		wm.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// add registers a connection, unless the manager is shut down.
+func (wm *WebsocketManager) add(con *wsConnection) bool {
+	wm.mtx.Lock()
+	defer wm.mtx.Unlock()
+	if wm.closed {
+		return false
+	}
+	wm.conns[con] = struct{}{}
+	wm.wg.Add(1)
+	return true
+}
+
+func (wm *WebsocketManager) remove(con *wsConnection) {
+	wm.mtx.Lock()
+	delete(wm.conns, con)
+	wm.mtx.Unlock()
+	wm.wg.Done()
+}
+
+// WebSocket connection
+
+// A single websocket connection contains listener id, underlying ws
+// connection, and the channel of pending responses.
+//
+// In case of an error, the connection is stopped.
+type wsConnection struct {
+	remoteAddr string
+	baseConn   *websocket.Conn
+	writeChan  chan types.RPCResponse
+	logger     zerolog.Logger
+
+	funcMap map[string]*RPCFunc
+	cdc     *amino.Codec
+
+	// closed by Stop, signals both routines to exit.
+	quit     chan struct{}
+	stopOnce sync.Once
+
+	// parent of the contexts passed to the functions, cancelled by Stop.
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	// write channel capacity
+	writeChanCapacity int
+
+	// maximum size of a message read from the client, 0 means unlimited.
+	readLimit int64
+
+	// each write times out after this.
+	writeWait time.Duration
+
+	// Connection times out if we haven't received *anything* in this long, not even pings.
+	readWait time.Duration
+
+	// Send pings to the client with this period. Must be less than readWait, but greater than zero.
+	pingPeriod time.Duration
+
+	// callback which is called upon disconnect
+	onDisconnect func(remoteAddr string)
+
+	// event bus for the built-in subscribe / unsubscribe methods, nil disables them.
+	eventBus *EventBus
+	builtins map[string]*RPCFunc
+
+	// wraps every call, nil if there are no interceptors.
+	interceptor Interceptor
+
+	// the upgrade request, if the connection was accepted by a WebsocketManager.
+	httpRequest *http.Request
+}
+
+// NewWSConnection wraps websocket.Conn.
+//
+// See the commentary on the func(*wsConnection) functions for a detailed
+// description of how to configure ping period and pong wait time. NOTE: if the
+// write buffer is full, pongs may be dropped, which may cause clients to
+// disconnect. see https://github.com/gorilla/websocket/issues/97
+func NewWSConnection(baseConn *websocket.Conn, funcMap map[string]*RPCFunc, cdc *amino.Codec, options ...func(*wsConnection)) *wsConnection {
+	wsc := &wsConnection{
+		remoteAddr:        baseConn.RemoteAddr().String(),
+		baseConn:          baseConn,
+		funcMap:           funcMap,
+		cdc:               cdc,
+		quit:              make(chan struct{}),
+		writeWait:         defaultWSWriteWait,
+		writeChanCapacity: defaultWSWriteChanCapacity,
+		readWait:          defaultWSReadWait,
+		pingPeriod:        defaultWSPingPeriod,
+	}
+	for _, option := range options {
+		option(wsc)
+	}
+	wsc.logger = logger.With().Str("remote", wsc.remoteAddr).Logger()
+	wsc.ctx, wsc.cancel = context.WithCancel(context.Background())
+	wsc.writeChan = make(chan types.RPCResponse, wsc.writeChanCapacity)
+	if wsc.eventBus != nil {
+		wsc.builtins = map[string]*RPCFunc{
+			"subscribe":       NewWSRPCFunc(wsc.subscribe, "query"),
+			"unsubscribe":     NewWSRPCFunc(wsc.unsubscribe, "query"),
+			"unsubscribe_all": NewWSRPCFunc(wsc.unsubscribeAll, ""),
+		}
+	}
+	return wsc
+}
+
+// WriteWait sets the amount of time to wait before a websocket write times out.
+// It should only be used in the constructor - not Goroutine-safe.
+func WriteWait(writeWait time.Duration) func(*wsConnection) {
+	return func(wsc *wsConnection) {
+		wsc.writeWait = writeWait
+	}
+}
+
+// WriteChanCapacity sets the capacity of the websocket write channel.
+// It should only be used in the constructor - not Goroutine-safe.
+func WriteChanCapacity(cap int) func(*wsConnection) {
+	return func(wsc *wsConnection) {
+		wsc.writeChanCapacity = cap
+	}
+}
+
+// ReadLimit sets the maximum size in bytes of a message read from the client.
+// The connection is closed if a message exceeds it.
+// It should only be used in the constructor - not Goroutine-safe.
+func ReadLimit(readLimit int64) func(*wsConnection) {
+	return func(wsc *wsConnection) {
+		wsc.readLimit = readLimit
+	}
+}
+
+// ReadWait sets the amount of time to wait before a websocket read times out.
+// It should only be used in the constructor - not Goroutine-safe.
+func ReadWait(readWait time.Duration) func(*wsConnection) {
+	return func(wsc *wsConnection) {
+		wsc.readWait = readWait
+	}
+}
+
+// PingPeriod sets the duration for sending websocket pings.
+// It should only be used in the constructor - not Goroutine-safe.
+func PingPeriod(pingPeriod time.Duration) func(*wsConnection) {
+	return func(wsc *wsConnection) {
+		wsc.pingPeriod = pingPeriod
+	}
+}
+
+// OnDisconnect sets a callback which is used upon disconnect - not
+// Goroutine-safe. Nop by default.
+func OnDisconnect(onDisconnect func(remoteAddr string)) func(*wsConnection) {
+	return func(wsc *wsConnection) {
+		wsc.onDisconnect = onDisconnect
+	}
+}
+
+// WithEventBus enables the built-in subscribe, unsubscribe and
+// unsubscribe_all methods, which subscribe the connection to the events
+// published on eventBus under a query. Subscriptions are removed when the
+// connection closes.
+// It should only be used in the constructor - not Goroutine-safe.
+func WithEventBus(eventBus *EventBus) func(*wsConnection) {
+	return func(wsc *wsConnection) {
+		wsc.eventBus = eventBus
+	}
+}
+
+// WithInterceptors sets the interceptors wrapping every call on the
+// connection, the first one being the outermost.
+// It should only be used in the constructor - not Goroutine-safe.
+func WithInterceptors(interceptors ...Interceptor) func(*wsConnection) {
+	return func(wsc *wsConnection) {
+		wsc.interceptor = ChainInterceptors(interceptors...)
+	}
+}
+
+// Start starts the read and write routines. It blocks until the connection
+// closes.
+func (wsc *wsConnection) Start() {
+	// Read requests from the client
+	go wsc.readRoutine()
+	// Write responses, BLOCKING.
+	wsc.writeRoutine()
+}
+
+// Stop signals both routines to exit. It is safe to call more than once.
+// Both read and write loops close the websocket connection when they exit
+// their loops. The writeChan is never closed, to allow WriteRPCResponse() to
+// fail.
+func (wsc *wsConnection) Stop() {
+	wsc.stopOnce.Do(func() {
+		close(wsc.quit)
+		wsc.cancel()
+		if wsc.eventBus != nil {
+			wsc.eventBus.UnsubscribeAll(wsc.remoteAddr) // nolint: errcheck
+		}
+		if wsc.onDisconnect != nil {
+			wsc.onDisconnect(wsc.remoteAddr)
+		}
+	})
+}
+
+// closeGracefully sends a close frame to the client and stops the connection.
+func (wsc *wsConnection) closeGracefully(code int, text string) {
+	msg := websocket.FormatCloseMessage(code, text)
+	if err := wsc.baseConn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(wsc.writeWait)); err != nil {
+		wsc.logger.Info().Err(err).Msg("Failed to write close frame")
+	}
+	wsc.Stop()
+	// Start may not have been called, in which case no routine closes the
+	// connection.
+	wsc.baseConn.Close() // nolint: errcheck
+}
+
+// GetRemoteAddr returns the remote address of the underlying connection.
+// It implements WSRPCConnection
+func (wsc *wsConnection) GetRemoteAddr() string {
+	return wsc.remoteAddr
+}
+
+// WriteRPCResponse pushes a response to the writeChan, and blocks until it is accepted.
+// It implements WSRPCConnection. It is Goroutine-safe.
+func (wsc *wsConnection) WriteRPCResponse(resp types.RPCResponse) {
+	select {
+	case <-wsc.quit:
+		return
+	case wsc.writeChan <- resp:
+	}
+}
+
+// TryWriteRPCResponse attempts to push a response to the writeChan, but does not block.
+// It implements WSRPCConnection. It is Goroutine-safe
+func (wsc *wsConnection) TryWriteRPCResponse(resp types.RPCResponse) bool {
+	select {
+	case <-wsc.quit:
+		return false
+	case wsc.writeChan <- resp:
+		return true
+	default:
+		return false
+	}
+}
+
+// Codec returns an amino codec used to decode parameters and encode results.
+// It implements WSRPCConnection.
+func (wsc *wsConnection) Codec() *amino.Codec {
+	return wsc.cdc
+}
+
+// Read from the socket and dispatch requests to the funcMap
+func (wsc *wsConnection) readRoutine() {
+	defer func() {
+		// panics of the handlers are recovered by executeRequest
+		if r := recover(); r != nil {
+			wsc.logger.Error().Str("stack", string(debug.Stack())).Msgf("Panic in WSJSONRPC read routine: %v", r)
+		}
+		wsc.baseConn.Close() // nolint: errcheck
+	}()
+
+	if wsc.readLimit > 0 {
+		wsc.baseConn.SetReadLimit(wsc.readLimit)
+	}
+	wsc.baseConn.SetPongHandler(func(m string) error {
+		return wsc.baseConn.SetReadDeadline(time.Now().Add(wsc.readWait))
+	})
+
+	for {
+		select {
+		case <-wsc.quit:
+			return
+		default:
+			// reset deadline for every type of message (control or data)
+			if err := wsc.baseConn.SetReadDeadline(time.Now().Add(wsc.readWait)); err != nil {
+				wsc.logger.Error().Err(err).Msg("failed to set read deadline")
+			}
+			_, in, err := wsc.baseConn.ReadMessage()
+			if err != nil {
+				select {
+				case <-wsc.quit:
+					// closed by the server
+				default:
+					if websocket.IsCloseError(err, websocket.CloseNormalClosure) {
+						wsc.logger.Info().Msg("Client closed the connection")
+					} else {
+						wsc.logger.Error().Err(err).Msg("Failed to read request")
+					}
+				}
+				wsc.Stop()
+				return
+			}
+
+			var request types.RPCRequest
+			err = json.Unmarshal(in, &request)
+			if err != nil {
+				wsc.WriteRPCResponse(types.RPCParseError(types.NullID(), errors.Wrap(err, "Error unmarshalling request")))
+				continue
+			}
+
+			response := wsc.executeRequest(request)
+			// A Notification is a Request object without an "id" member.
+			// The Server MUST NOT reply to a Notification.
+			if request.ID.IsEmpty() {
+				if response.Error != nil {
+					wsc.logger.Debug().Str("method", request.Method).Str("err", response.Error.Error()).Msg("WSJSONRPC notification failed")
+				}
+				continue
+			}
+			wsc.WriteRPCResponse(response)
+		}
+	}
+}
+
+// executeRequest fetches the RPCFunc of the request and executes it.
+func (wsc *wsConnection) executeRequest(request types.RPCRequest) (response types.RPCResponse) {
+	defer func() {
+		if e := recover(); e != nil {
+			if res, ok := e.(types.RPCResponse); ok {
+				response = res
+				return
+			}
+			wsc.logger.Error().Str("stack", string(debug.Stack())).Msg("Panic in WSJSONRPC handler")
+			response = types.RPCInternalError(request.ID, errors.Errorf("%v", e))
+		}
+	}()
+	rpcFunc := wsc.funcMap[request.Method]
+	if rpcFunc == nil {
+		rpcFunc = wsc.builtins[request.Method]
+	}
+	if rpcFunc == nil {
+		return types.RPCMethodNotFoundError(request.ID)
+	}
+	// "params" may be omitted, which is treated the same as null.
+	params := request.Params
+	if len(params) == 0 {
+		params = json.RawMessage("null")
+	}
+	var args []reflect.Value
+	var err error
+	if rpcFunc.ws {
+		wsCtx := types.WSRPCContext{Request: request, WSRPCConnection: wsc}
+		args, err = jsonParamsToArgsWS(rpcFunc, wsc.cdc, params, wsCtx)
+	} else {
+		args, err = jsonParamsToArgsRPC(rpcFunc, wsc.cdc, params)
+	}
+	if err != nil {
+		return invalidParamsResponse(request.ID, errors.Wrap(err, "Error converting json params to arguments"))
+	}
+	info := newCallInfo(rpcFunc, TransportWebsocket, request.ID, wsc.remoteAddr, request.Method, wsc.httpRequest, args)
+	result, err := rpcFunc.invoke(wsc.ctx, info, args, wsc.interceptor)
+	wsc.logger.Info().Str("method", request.Method).Msg("WSJSONRPC")
+	if err != nil {
+		return errorResponse(wsc.cdc, request.ID, err)
+	}
+	return types.NewRPCSuccessResponse(wsc.cdc, request.ID, result)
+}
+
+// receives on a write channel and writes out on the socket
+func (wsc *wsConnection) writeRoutine() {
+	pingTicker := time.NewTicker(wsc.pingPeriod)
+	defer func() {
+		pingTicker.Stop()
+		if err := wsc.baseConn.Close(); err != nil {
+			wsc.logger.Error().Err(err).Msg("Error closing connection")
+		}
+	}()
+
+	// https://github.com/gorilla/websocket/issues/97
+	pongs := make(chan string, 1)
+	wsc.baseConn.SetPingHandler(func(m string) error {
+		select {
+		case pongs <- m:
+		default:
+		}
+		return nil
+	})
+
+	for {
+		select {
+		case m := <-pongs:
+			err := wsc.writeMessageWithDeadline(websocket.PongMessage, []byte(m))
+			if err != nil {
+				wsc.logger.Info().Err(err).Msg("Failed to write pong (client may disconnect)")
+			}
+		case <-pingTicker.C:
+			err := wsc.writeMessageWithDeadline(websocket.PingMessage, []byte{})
+			if err != nil {
+				wsc.logger.Error().Err(err).Msg("Failed to write ping")
+				wsc.Stop()
+				return
+			}
+		case msg := <-wsc.writeChan:
+			jsonBytes, err := json.MarshalIndent(msg, "", "  ")
+			if err != nil {
+				wsc.logger.Error().Err(err).Msg("Failed to marshal RPCResponse to JSON")
+			} else if err = wsc.writeMessageWithDeadline(websocket.TextMessage, jsonBytes); err != nil {
+				wsc.logger.Error().Err(err).Msg("Failed to write response")
+				wsc.Stop()
+				return
+			}
+		case <-wsc.quit:
+			return
+		}
+	}
+}
+
+// subscribe implements the built-in subscribe method. Events are pushed with
+// the ID of the subscribe request suffixed by "#event".
+func (wsc *wsConnection) subscribe(wsCtx types.WSRPCContext, query string) (*types.ResultSubscribe, error) {
+	if query == "" {
+		return nil, errors.New("query is empty")
+	}
+	sub, err := wsc.eventBus.Subscribe(wsc.remoteAddr, query)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to subscribe")
+	}
+	go wsc.forwardEvents(types.StringID(wsCtx.Request.ID.String()+"#event"), query, sub)
+	return &types.ResultSubscribe{}, nil
+}
+
+// unsubscribe implements the built-in unsubscribe method.
+func (wsc *wsConnection) unsubscribe(wsCtx types.WSRPCContext, query string) (*types.ResultUnsubscribe, error) {
+	if err := wsc.eventBus.Unsubscribe(wsc.remoteAddr, query); err != nil {
+		return nil, errors.Wrap(err, "failed to unsubscribe")
+	}
+	return &types.ResultUnsubscribe{}, nil
+}
+
+// unsubscribeAll implements the built-in unsubscribe_all method.
+func (wsc *wsConnection) unsubscribeAll(wsCtx types.WSRPCContext) (*types.ResultUnsubscribe, error) {
+	if err := wsc.eventBus.UnsubscribeAll(wsc.remoteAddr); err != nil {
+		return nil, errors.Wrap(err, "failed to unsubscribe")
+	}
+	return &types.ResultUnsubscribe{}, nil
+}
+
+// forwardEvents writes the events of sub to the socket until the subscription
+// is cancelled or the connection closes. A slow consumer is disconnected.
+func (wsc *wsConnection) forwardEvents(id types.JSONRPCID, query string, sub *Subscription) {
+	for {
+		select {
+		case event := <-sub.Out():
+			wsc.WriteRPCResponse(types.NewRPCEventResponse(wsc.cdc, id, event.Query, event.Data))
+		case <-sub.Cancelled():
+			if sub.Err() == ErrSlowConsumer {
+				wsc.logger.Info().Msg("Disconnecting slow subscriber")
+				wsc.Stop()
+			}
+			return
+		case <-wsc.quit:
+			// Stop may have run UnsubscribeAll before this subscription was
+			// added, so remove it here as well.
+			wsc.eventBus.Unsubscribe(wsc.remoteAddr, query) // nolint: errcheck
+			return
+		}
+	}
+}
+
+// All writes to the websocket must (re)set the write deadline.
+// If some writes don't set it while others do, they may timeout incorrectly (https://github.com/tendermint/tendermint/issues/553)
+func (wsc *wsConnection) writeMessageWithDeadline(msgType int, msg []byte) error {
+	if err := wsc.baseConn.SetWriteDeadline(time.Now().Add(wsc.writeWait)); err != nil {
+		return err
+	}
+	return wsc.baseConn.WriteMessage(msgType, msg)
+}
+
+// rpc.websocket
+//-----------------------------------------------------------------------------
+
+// unreflectResult converts the values returned by an RPC function, as allowed
+// by checkReturns, to its result and error. If the error is not nil, it is
+// returned without the result; functions returning only an error or nothing
+// have a nil result.
 func unreflectResult(returns []reflect.Value) (interface{}, error) {
-	errV := returns[1]
-	if errV.Interface() != nil {
-		return nil, errors.Errorf("%v", errV.Interface())
+	if len(returns) == 0 {
+		return nil, nil
 	}
 	rv := returns[0]
+	if len(returns) == 2 {
+		if err, ok := returns[1].Interface().(error); ok {
+			return nil, err
+		}
+	} else if rv.Type() == errorType {
+		if err, ok := rv.Interface().(error); ok {
+			return nil, err
+		}
+		return nil, nil
+	}
 	// the result is a registered interface,
 	// we need a pointer to it so we can marshal with type byte
 	rvp := reflect.New(rv.Type())
@@ -407,6 +1327,44 @@ func unreflectResult(returns []reflect.Value) (interface{}, error) {
 	return rvp.Interface(), nil
 }
 
+// errorResponse returns the response for an error returned by an RPC function
+// or an interceptor. A types.CodedError keeps its code and data, and an error
+// registered with types.RegisterError gets its code, also when wrapped with
+// fmt.Errorf("%w") or pkg/errors, see unwrapError. The outermost match wins.
+// Any other error is an internal error.
+func errorResponse(cdc *amino.Codec, id types.JSONRPCID, err error) types.RPCResponse {
+	for e := err; e != nil; e = unwrapError(e) {
+		if coded, ok := e.(types.CodedError); ok {
+			data, err := types.EncodeErrorData(cdc, coded.RPCData())
+			if err != nil {
+				return types.RPCInternalError(id, errors.Wrap(err, "Error marshalling error data"))
+			}
+			msg := coded.Error()
+			if rpcErr, ok := coded.(*types.RPCError); ok {
+				msg = rpcErr.Message
+			}
+			return types.NewRPCErrorResponseWithData(id, coded.RPCCode(), msg, data)
+		}
+		if code, ok := types.RegisteredCode(e); ok {
+			return types.NewRPCErrorResponse(id, code, err.Error(), "")
+		}
+	}
+	return types.RPCInternalError(id, err)
+}
+
+// unwrapError returns the error wrapped by err, following the Unwrap method of
+// the standard library, or else the Cause method of pkg/errors, which has no
+// Unwrap method. It returns nil if err wraps no error.
+func unwrapError(err error) error {
+	if wrapped := stderrors.Unwrap(err); wrapped != nil {
+		return wrapped
+	}
+	if causer, ok := err.(interface{ Cause() error }); ok {
+		return causer.Cause()
+	}
+	return nil
+}
+
 // writes a list of available rpc endpoints as an html page
 func writeListOfEndpoints(w http.ResponseWriter, r *http.Request, funcMap map[string]*RPCFunc) {
 	noArgNames := []string{}
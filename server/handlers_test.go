@@ -1,13 +1,18 @@
 package krpcs
 
 import (
+	"context"
 	"encoding/json"
+	"fmt"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
 	"strings"
 	"testing"
+	"time"
 
+	"github.com/gorilla/websocket"
+	"github.com/pkg/errors"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 
@@ -80,11 +85,27 @@ func TestRPCParams(t *testing.T) {
 		} else {
 			assert.True(t, recv.Error.Code < 0, "#%d: not expecting a positive JSONRPC code", i)
 			// The wanted error is either in the message or the data
-			assert.Contains(t, recv.Error.Message+recv.Error.Data, tt.wantErr, "#%d: expected substring", i)
+			assert.Contains(t, recv.Error.Message+string(recv.Error.Data), tt.wantErr, "#%d: expected substring", i)
 		}
 	}
 }
 
+func TestRPCIDs(t *testing.T) {
+	mux := testMux()
+	for _, id := range []string{`"0"`, `7`, `-1`, `null`} {
+		body := strings.NewReader(`{"jsonrpc": "2.0", "method": "c", "id": ` + id + `, "params": ["a", "10"]}`)
+		req, _ := http.NewRequest("POST", "http://localhost/", body)
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, req)
+
+		var recv struct {
+			ID json.RawMessage `json:"id"`
+		}
+		require.Nil(t, json.Unmarshal(rec.Body.Bytes(), &recv), "id %s", id)
+		assert.Equal(t, id, string(recv.ID), "the id is returned as received")
+	}
+}
+
 func TestRPCNotification(t *testing.T) {
 	mux := testMux()
 	body := strings.NewReader(`{"jsonrpc": "2.0"}`)
@@ -95,11 +116,556 @@ func TestRPCNotification(t *testing.T) {
 
 	// Always expecting back a JSONRPCResponse
 	require.True(t, statusOK(res.StatusCode), "should always return 2XX")
+	require.Equal(t, http.StatusNoContent, res.StatusCode)
 	blob, err := ioutil.ReadAll(res.Body)
 	require.Nil(t, err, "reading from the body should not give back an error")
 	require.Equal(t, len(blob), 0, "a notification SHOULD NOT be responded to by the server")
 }
 
+func TestRPCNotificationIsExecuted(t *testing.T) {
+	for _, workers := range []int{0, 2} {
+		called := make(chan string, 1)
+		funcMap := map[string]*RPCFunc{
+			"c": NewRPCFunc(func(s string) (string, error) { called <- s; return s, nil }, "s"),
+		}
+		config := DefaultConfig()
+		config.MaxNotificationWorkers = workers
+		mux := http.NewServeMux()
+		RegisterRPCFuncsWithConfig(mux, funcMap, amino.NewCodec(), config)
+
+		body := strings.NewReader(`{"jsonrpc": "2.0", "method": "c", "params": ["fire"]}`)
+		req, _ := http.NewRequest("POST", "http://localhost/", body)
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, req)
+
+		require.Equal(t, http.StatusNoContent, rec.Code, "workers: %d", workers)
+		require.Equal(t, 0, rec.Body.Len(), "workers: %d", workers)
+		select {
+		case s := <-called:
+			assert.Equal(t, "fire", s)
+		case <-time.After(time.Second):
+			t.Fatalf("notification was not executed (workers: %d)", workers)
+		}
+	}
+}
+
+func TestRPCBatch(t *testing.T) {
+	funcMap := map[string]*RPCFunc{
+		"c": NewRPCFunc(func(s string, i int) (string, error) { return s, nil }, "s,i"),
+		"p": NewRPCFunc(func() (string, error) { panic("boom") }, ""),
+	}
+	config := DefaultConfig()
+	config.MaxBatchSize = 4
+	config.MaxBatchWorkers = 2
+	mux := http.NewServeMux()
+	RegisterRPCFuncsWithConfig(mux, funcMap, amino.NewCodec(), config)
+
+	post := func(payload string) []byte {
+		req, _ := http.NewRequest("POST", "http://localhost/", strings.NewReader(payload))
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, req)
+		require.True(t, statusOK(rec.Code), "should always return 2XX")
+		return rec.Body.Bytes()
+	}
+
+	var responses []types.RPCResponse
+	blob := post(`[
+		{"jsonrpc": "2.0", "method": "c", "id": "1", "params": ["a", "10"]},
+		{"jsonrpc": "2.0", "method": "c", "params": ["n", "10"]},
+		{"jsonrpc": "2.0", "method": "y", "id": "2"},
+		1,
+		{"jsonrpc": "2.0", "method": "p", "id": "3"}
+	]`)
+	// too big
+	recv := new(types.RPCResponse)
+	require.Nil(t, json.Unmarshal(blob, recv), "blob: %s", blob)
+	require.NotNil(t, recv.Error)
+	assert.Equal(t, -32600, recv.Error.Code)
+
+	blob = post(`[
+		{"jsonrpc": "2.0", "method": "c", "id": "1", "params": ["a", "10"]},
+		{"jsonrpc": "2.0", "method": "c", "params": ["n", "10"]},
+		{"jsonrpc": "2.0", "method": "y", "id": "2"},
+		{"jsonrpc": "2.0", "method": "p", "id": "3"}
+	]`)
+	require.Nil(t, json.Unmarshal(blob, &responses), "blob: %s", blob)
+	require.Len(t, responses, 3, "notifications get no response")
+	assert.Equal(t, types.StringID("1"), responses[0].ID)
+	assert.Nil(t, responses[0].Error)
+	assert.Equal(t, `"a"`, string(responses[0].Result))
+	assert.Equal(t, types.StringID("2"), responses[1].ID)
+	assert.Equal(t, -32601, responses[1].Error.Code)
+	assert.Equal(t, types.StringID("3"), responses[2].ID)
+	assert.Equal(t, -32603, responses[2].Error.Code)
+
+	// invalid elements
+	responses = nil
+	blob = post(`[1, 2]`)
+	require.Nil(t, json.Unmarshal(blob, &responses), "blob: %s", blob)
+	require.Len(t, responses, 2)
+	assert.Equal(t, -32600, responses[0].Error.Code)
+
+	// empty batch
+	blob = post(`[]`)
+	require.Nil(t, json.Unmarshal(blob, recv), "blob: %s", blob)
+	assert.Equal(t, -32600, recv.Error.Code)
+
+	// only notifications
+	blob = post(`[{"jsonrpc": "2.0", "method": "c", "params": ["n", "10"]}]`)
+	assert.Len(t, blob, 0)
+}
+
+func TestRPCContext(t *testing.T) {
+	type callInfo struct {
+		id         types.JSONRPCID
+		remoteAddr string
+		method     string
+	}
+	infos := make(chan callInfo, 1)
+	f := func(ctx context.Context, s string) (string, error) {
+		id, _ := RequestIDFromContext(ctx)
+		remoteAddr, _ := RemoteAddrFromContext(ctx)
+		method, _ := MethodFromContext(ctx)
+		infos <- callInfo{id, remoteAddr, method}
+		return s, ctx.Err()
+	}
+	funcMap := map[string]*RPCFunc{
+		"ctx":    NewRPCFunc(f, "s"),
+		"ws_ctx": NewWSRPCFunc(func(ctx context.Context, wsCtx types.WSRPCContext, s string) (string, error) { return f(ctx, s) }, "s"),
+	}
+	mux := http.NewServeMux()
+	RegisterRPCFuncs(mux, funcMap, amino.NewCodec())
+	RegisterWSFuncs(mux, "", funcMap, amino.NewCodec())
+
+	// JSON-RPC
+	req, _ := http.NewRequest("POST", "http://localhost/", strings.NewReader(`{"jsonrpc": "2.0", "method": "ctx", "id": 5, "params": ["a"]}`))
+	req.RemoteAddr = "1.2.3.4:5"
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, req)
+	assert.Equal(t, callInfo{types.IntID(5), "1.2.3.4:5", "ctx"}, <-infos)
+	recv := new(types.RPCResponse)
+	require.Nil(t, json.Unmarshal(rec.Body.Bytes(), recv))
+	assert.Nil(t, recv.Error)
+
+	// URI
+	req, _ = http.NewRequest("GET", `http://localhost/ctx?s="a"`, nil)
+	req.RemoteAddr = "1.2.3.4:5"
+	rec = httptest.NewRecorder()
+	mux.ServeHTTP(rec, req)
+	assert.Equal(t, callInfo{types.JSONRPCID{}, "1.2.3.4:5", "ctx"}, <-infos)
+
+	// websocket
+	s := httptest.NewServer(mux)
+	defer s.Close()
+	c, _, err := websocket.DefaultDialer.Dial("ws://"+s.Listener.Addr().String()+DefaultWSPath, nil)
+	require.NoError(t, err)
+	defer c.Close()
+	wsReq, err := types.ArrayToRequest(amino.NewCodec(), types.StringID("ws"), "ws_ctx", []interface{}{"a"})
+	require.NoError(t, err)
+	require.NoError(t, c.WriteJSON(wsReq))
+	var resp types.RPCResponse
+	require.NoError(t, c.ReadJSON(&resp))
+	assert.Nil(t, resp.Error)
+	info := <-infos
+	assert.Equal(t, types.StringID("ws"), info.id)
+	assert.Equal(t, "ws_ctx", info.method)
+	assert.NotEmpty(t, info.remoteAddr)
+}
+
+func TestRPCInterceptors(t *testing.T) {
+	var calls []string
+	record := func(name string) Interceptor {
+		return func(ctx context.Context, info *CallInfo, next Invoker) (interface{}, error) {
+			calls = append(calls, name+":"+string(info.Transport)+":"+info.Method)
+			return next(ctx, info)
+		}
+	}
+	auth := func(ctx context.Context, info *CallInfo, next Invoker) (interface{}, error) {
+		if info.Args[0] == "forbidden" {
+			return nil, errors.New("unauthorized")
+		}
+		return next(ctx, info)
+	}
+	funcMap := map[string]*RPCFunc{
+		"echo": NewRPCFunc(func(ctx context.Context, s string) (string, error) { return s, nil }, "s"),
+	}
+	interceptors := []Interceptor{record("a"), record("b"), auth}
+	config := DefaultConfig()
+	config.Interceptors = interceptors
+	mux := http.NewServeMux()
+	RegisterRPCFuncsWithConfig(mux, funcMap, amino.NewCodec(), config)
+	RegisterWSFuncs(mux, "", funcMap, amino.NewCodec(), WithInterceptors(interceptors...))
+
+	// JSON-RPC
+	for _, arg := range []string{"hi", "forbidden"} {
+		req, _ := http.NewRequest("POST", "http://localhost/", strings.NewReader(`{"jsonrpc": "2.0", "method": "echo", "id": 1, "params": ["`+arg+`"]}`))
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, req)
+		recv := new(types.RPCResponse)
+		require.Nil(t, json.Unmarshal(rec.Body.Bytes(), recv))
+		if arg == "forbidden" {
+			require.NotNil(t, recv.Error)
+			assert.Contains(t, string(recv.Error.Data), "unauthorized")
+		} else {
+			assert.Nil(t, recv.Error)
+		}
+	}
+	assert.Equal(t, []string{"a:jsonrpc:echo", "b:jsonrpc:echo", "a:jsonrpc:echo", "b:jsonrpc:echo"}, calls)
+
+	// URI
+	calls = nil
+	req, _ := http.NewRequest("GET", `http://localhost/echo?s="hi"`, nil)
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, req)
+	assert.Equal(t, []string{"a:uri:echo", "b:uri:echo"}, calls)
+
+	// websocket
+	calls = nil
+	s := httptest.NewServer(mux)
+	defer s.Close()
+	c, _, err := websocket.DefaultDialer.Dial("ws://"+s.Listener.Addr().String()+DefaultWSPath, nil)
+	require.NoError(t, err)
+	defer c.Close()
+	wsReq, err := types.ArrayToRequest(amino.NewCodec(), types.StringID("ws"), "echo", []interface{}{"forbidden"})
+	require.NoError(t, err)
+	require.NoError(t, c.WriteJSON(wsReq))
+	var resp types.RPCResponse
+	require.NoError(t, c.ReadJSON(&resp))
+	require.NotNil(t, resp.Error)
+	assert.Contains(t, string(resp.Error.Data), "unauthorized")
+	assert.Equal(t, []string{"a:websocket:echo", "b:websocket:echo"}, calls)
+}
+
+type notFoundError struct {
+	key string
+}
+
+func (e notFoundError) Error() string        { return e.key + " not found" }
+func (e notFoundError) RPCCode() int         { return 404 }
+func (e notFoundError) RPCData() interface{} { return map[string]string{"key": e.key} }
+
+type stateData struct {
+	State string `json:"state"`
+}
+
+func TestRPCCodedErrors(t *testing.T) {
+	funcMap := map[string]*RPCFunc{
+		"rpc_error": NewRPCFunc(func() (string, error) { return "", types.NewRPCError(1, "invalid state", stateData{"closed"}) }, ""),
+		"wrapped":   NewRPCFunc(func() (string, error) { return "", errors.Wrap(notFoundError{"k"}, "lookup") }, ""),
+		"wrapped_w": NewRPCFunc(func() (string, error) { return "", fmt.Errorf("lookup: %w", notFoundError{"k"}) }, ""),
+		"mixed": NewRPCFunc(func() (string, error) {
+			return "", fmt.Errorf("call: %w", errors.Wrap(notFoundError{"k"}, "lookup"))
+		}, ""),
+		"plain":     NewRPCFunc(func() (string, error) { return "", errors.New("boom") }, ""),
+	}
+	mux := http.NewServeMux()
+	RegisterRPCFuncs(mux, funcMap, amino.NewCodec())
+
+	tests := []struct {
+		method string
+		want   types.RPCError
+	}{
+		{"rpc_error", types.RPCError{Code: 1, Message: "invalid state", Data: json.RawMessage(`{"state":"closed"}`)}},
+		{"wrapped", types.RPCError{Code: 404, Message: "k not found", Data: json.RawMessage(`{"key":"k"}`)}},
+		{"wrapped_w", types.RPCError{Code: 404, Message: "k not found", Data: json.RawMessage(`{"key":"k"}`)}},
+		{"mixed", types.RPCError{Code: 404, Message: "k not found", Data: json.RawMessage(`{"key":"k"}`)}},
+		{"plain", types.RPCError{Code: -32603, Message: "Internal error", Data: json.RawMessage(`"boom"`)}},
+	}
+	for _, tt := range tests {
+		for _, req := range []*http.Request{
+			httptest.NewRequest("POST", "/", strings.NewReader(`{"jsonrpc": "2.0", "method": "`+tt.method+`", "id": 1}`)),
+			httptest.NewRequest("GET", "/"+tt.method, nil),
+		} {
+			rec := httptest.NewRecorder()
+			mux.ServeHTTP(rec, req)
+			recv := new(types.RPCResponse)
+			require.Nil(t, json.Unmarshal(rec.Body.Bytes(), recv))
+			if assert.NotNil(t, recv.Error, tt.method) {
+				assert.Equal(t, tt.want.Code, recv.Error.Code, tt.method)
+				assert.Equal(t, tt.want.Message, recv.Error.Message, tt.method)
+				assert.JSONEq(t, string(tt.want.Data), string(recv.Error.Data), tt.method)
+			}
+		}
+	}
+}
+
+func TestRPCReturnSignatures(t *testing.T) {
+	funcMap := map[string]*RPCFunc{
+		"result":     NewRPCFunc(func() string { return "r" }, ""),
+		"error":      NewRPCFunc(func() error { return nil }, ""),
+		"error_fail": NewRPCFunc(func() error { return errors.New("boom") }, ""),
+		"both":       NewRPCFunc(func() (string, error) { return "b", nil }, ""),
+		"nothing":    NewRPCFunc(func() {}, ""),
+	}
+	mux := http.NewServeMux()
+	RegisterRPCFuncs(mux, funcMap, amino.NewCodec())
+
+	tests := []struct {
+		method     string
+		wantResult string
+		wantErr    string
+	}{
+		{"result", `"r"`, ""},
+		{"error", `null`, ""},
+		{"error_fail", "", "boom"},
+		{"both", `"b"`, ""},
+		{"nothing", `null`, ""},
+	}
+	for _, tt := range tests {
+		req, _ := http.NewRequest("POST", "http://localhost/", strings.NewReader(`{"jsonrpc": "2.0", "method": "`+tt.method+`", "id": 1}`))
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, req)
+		recv := new(types.RPCResponse)
+		require.Nil(t, json.Unmarshal(rec.Body.Bytes(), recv), tt.method)
+		if tt.wantErr != "" {
+			if assert.NotNil(t, recv.Error, tt.method) {
+				assert.Contains(t, string(recv.Error.Data), tt.wantErr, tt.method)
+			}
+			continue
+		}
+		assert.Nil(t, recv.Error, tt.method)
+		assert.Equal(t, tt.wantResult, string(recv.Result), tt.method)
+	}
+}
+
+func TestNewRPCFuncChecksReturns(t *testing.T) {
+	assert.Panics(t, func() { NewRPCFunc(func() (string, string) { return "", "" }, "") })
+	assert.Panics(t, func() { NewRPCFunc(func() (string, error, error) { return "", nil, nil }, "") })
+	assert.Panics(t, func() { NewWSRPCFunc(func(wsCtx types.WSRPCContext) (string, string) { return "", "" }, "") })
+	assert.Panics(t, func() { NewRPCFunc("not a func", "") })
+}
+
+func TestTryNewRPCFunc(t *testing.T) {
+	f := func(ctx context.Context, a string, b int) (string, error) { return a, nil }
+	wsF := func(wsCtx types.WSRPCContext, a string) (string, error) { return a, nil }
+	tests := []struct {
+		f       interface{}
+		args    string
+		ws      bool
+		wantErr string
+	}{
+		{f, "a,b", false, ""},
+		{f, " a , b ", false, ""},
+		{wsF, "a", true, ""},
+		{"not a func", "", false, "not a function"},
+		{f, "a", false, "takes 2 parameters, but 1 are named"},
+		{f, "a,b,c", false, "takes 2 parameters, but 3 are named"},
+		{f, "a,a", false, "repeated"},
+		{f, "a,", false, "empty"},
+		{wsF, "", true, "takes 1 parameters, but 0 are named"},
+		{f, "a,b", true, "must take types.WSRPCContext"},
+		{f, "a!, b=3", false, ""},
+		{f, "a?,b?", false, ""},
+		{f, "a,b=", false, "empty"},
+		{f, "a,b=x", false, "invalid default value"},
+		{f, "!,b", false, "empty"},
+		{func(p struct{ A, B int }) {}, "", false, ""},
+		{func(ctx context.Context, p *struct{ A, B int }) {}, "", false, ""},
+		{func(p struct{ A, B int }) {}, "a", false, ""},
+		{func(p struct{ A, B int }, c int) {}, "", false, "takes 2 parameters, but 0 are named"},
+	}
+	for i, tt := range tests {
+		var rpcFunc *RPCFunc
+		var err error
+		if tt.ws {
+			rpcFunc, err = TryNewWSRPCFunc(tt.f, tt.args)
+		} else {
+			rpcFunc, err = TryNewRPCFunc(tt.f, tt.args)
+		}
+		if tt.wantErr != "" {
+			if assert.Error(t, err, "#%d", i) {
+				assert.Contains(t, err.Error(), tt.wantErr, "#%d", i)
+			}
+			continue
+		}
+		if assert.NoError(t, err, "#%d", i) {
+			if tt.args == "" {
+				assert.Equal(t, []string{"A", "B"}, rpcFunc.argNames, "#%d", i)
+			} else {
+				assert.Equal(t, []string{"a", "b"}[:len(rpcFunc.argNames)], rpcFunc.argNames, "#%d", i)
+			}
+		}
+	}
+	assert.Panics(t, func() { NewRPCFunc(f, "a") })
+}
+
+func TestRPCOptionalParams(t *testing.T) {
+	funcMap := map[string]*RPCFunc{
+		"page": NewRPCFunc(func(q string, page, limit int) (string, error) {
+			return fmt.Sprintf("%s:%d:%d", q, page, limit), nil
+		}, "q!,page?,limit=20"),
+		"limit": NewRPCFunc(func(limit int) int { return limit }, "limit=20"),
+	}
+	mux := http.NewServeMux()
+	RegisterRPCFuncs(mux, funcMap, amino.NewCodec())
+
+	// "params" may be omitted
+	for _, payload := range []string{
+		`{"jsonrpc": "2.0", "method": "limit", "id": 1}`,
+		`[{"jsonrpc": "2.0", "method": "limit", "id": 1}]`,
+	} {
+		req, _ := http.NewRequest("POST", "http://localhost/", strings.NewReader(payload))
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, req)
+		body := strings.Trim(rec.Body.String(), "[] \n")
+		var recv types.RPCResponse
+		require.NoError(t, json.Unmarshal([]byte(body), &recv), payload)
+		assert.Nil(t, recv.Error, payload)
+		assert.Equal(t, `"20"`, string(recv.Result), payload)
+	}
+
+	tests := []struct {
+		params     string
+		wantResult string
+	}{
+		{`{"q": "a"}`, `"a:0:20"`},
+		{`{"q": "a", "page": "2", "limit": null}`, `"a:2:20"`},
+		{`{"q": "a", "limit": "5"}`, `"a:0:5"`},
+		{`["a"]`, `"a:0:20"`},
+		{`["a", "2"]`, `"a:2:20"`},
+		{`["a", "2", "5"]`, `"a:2:5"`},
+	}
+	for _, tt := range tests {
+		body := strings.NewReader(`{"jsonrpc": "2.0", "method": "page", "id": 1, "params": ` + tt.params + `}`)
+		req, _ := http.NewRequest("POST", "http://localhost/", body)
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, req)
+		var recv types.RPCResponse
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &recv), tt.params)
+		assert.Nil(t, recv.Error, tt.params)
+		assert.Equal(t, tt.wantResult, string(recv.Result), tt.params)
+	}
+
+	// URI params
+	req, _ := http.NewRequest("GET", "http://localhost/page?q=%22a%22&page=3", nil)
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, req)
+	var recv types.RPCResponse
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &recv))
+	assert.Nil(t, recv.Error)
+	assert.Equal(t, `"a:3:20"`, string(recv.Result))
+
+	// missing required params
+	for _, uri := range []string{"/page?page=3", "/page?q="} {
+		req, _ := http.NewRequest("GET", "http://localhost"+uri, nil)
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, req)
+		var recv types.RPCResponse
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &recv), uri)
+		require.NotNil(t, recv.Error, uri)
+		assert.Equal(t, types.CodeInvalidParams, recv.Error.Code, uri)
+	}
+	for _, params := range []string{`{}`, `{"q": null, "page": "1"}`, `[]`, ``} {
+		payload := `{"jsonrpc": "2.0", "method": "page", "id": 1`
+		if params != "" {
+			payload += `, "params": ` + params
+		}
+		for _, batch := range []bool{false, true} {
+			body := payload + "}"
+			if batch {
+				body = "[" + body + "]"
+			}
+			req, _ := http.NewRequest("POST", "http://localhost/", strings.NewReader(body))
+			rec := httptest.NewRecorder()
+			mux.ServeHTTP(rec, req)
+			var recv types.RPCResponse
+			require.NoError(t, json.Unmarshal([]byte(strings.Trim(rec.Body.String(), "[] \n")), &recv), body)
+			require.NotNil(t, recv.Error, body)
+			assert.Equal(t, types.CodeInvalidParams, recv.Error.Code, body)
+			if params != `[]` {
+				var fields []types.FieldError
+				require.NoError(t, recv.Error.DecodeData(&fields), body)
+				assert.Equal(t, []types.FieldError{{Field: "q", Message: "is required"}}, fields, body)
+			}
+		}
+	}
+}
+
+func TestRPCPanics(t *testing.T) {
+	funcMap := map[string]*RPCFunc{
+		"panic":      NewRPCFunc(func() { panic("boom") }, ""),
+		"panicError": NewRPCFunc(func() { panic(errors.New("boom")) }, ""),
+	}
+	mux := http.NewServeMux()
+	RegisterRPCFuncs(mux, funcMap, amino.NewCodec())
+	handler := RecoverAndLogHandler(mux)
+
+	for method := range funcMap {
+		body := strings.NewReader(`{"jsonrpc": "2.0", "method": "` + method + `", "id": 7}`)
+		req, _ := http.NewRequest("POST", "http://localhost/", body)
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		var recv types.RPCResponse
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &recv), method)
+		require.NotNil(t, recv.Error, method)
+		assert.Equal(t, types.CodeInternalError, recv.Error.Code, method)
+		assert.Equal(t, types.IntID(7), recv.ID, method)
+	}
+}
+
+type pageParams struct {
+	Query string `json:"q" rpc:"required"`
+	Page  int    `json:"page"`
+	Tags  []string
+}
+
+type pageResult struct {
+	Query string   `json:"q"`
+	Page  int      `json:"page"`
+	Tags  []string `json:"tags"`
+}
+
+func TestRPCParamsStruct(t *testing.T) {
+	funcMap := map[string]*RPCFunc{
+		"page": NewRPCFunc(func(ctx context.Context, p *pageParams) (*pageResult, error) {
+			return &pageResult{p.Query, p.Page, p.Tags}, nil
+		}, ""),
+		"page_ws": NewWSRPCFunc(func(wsCtx types.WSRPCContext, p pageParams) (*pageResult, error) {
+			return &pageResult{p.Query, p.Page, p.Tags}, nil
+		}, ""),
+	}
+	assert.Equal(t, []string{"q", "page", "Tags"}, funcMap["page"].argNames)
+	assert.Equal(t, []string{"q", "page", "Tags"}, funcMap["page_ws"].argNames)
+	mux := http.NewServeMux()
+	RegisterRPCFuncs(mux, funcMap, amino.NewCodec())
+
+	for _, params := range []string{
+		`{"q": "a", "page": "2", "Tags": ["x"]}`,
+		`["a", "2", ["x"]]`,
+	} {
+		body := strings.NewReader(`{"jsonrpc": "2.0", "method": "page", "id": 1, "params": ` + params + `}`)
+		req, _ := http.NewRequest("POST", "http://localhost/", body)
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, req)
+		var recv types.RPCResponse
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &recv), params)
+		assert.Nil(t, recv.Error, params)
+		assert.JSONEq(t, `{"q": "a", "page": "2", "tags": ["x"]}`, string(recv.Result), params)
+	}
+
+	req, _ := http.NewRequest("GET", `http://localhost/page?q="a"&page=2&Tags=["x"]`, nil)
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, req)
+	var recv types.RPCResponse
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &recv))
+	assert.Nil(t, recv.Error)
+	assert.JSONEq(t, `{"q": "a", "page": "2", "tags": ["x"]}`, string(recv.Result))
+
+	// structs without exported fields or decoding themselves are plain params,
+	// which must be named in args
+	for _, f := range []interface{}{
+		func(ts time.Time) {},
+		func(ctx context.Context, ts *time.Time) {},
+		func(p struct{ a int }) {},
+	} {
+		_, err := TryNewRPCFunc(f, "")
+		assert.Error(t, err, "%T", f)
+	}
+	rpcFunc, err := TryNewRPCFunc(func(ts time.Time) {}, "ts")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"ts"}, rpcFunc.argNames)
+}
+
 func TestUnknownRPCPath(t *testing.T) {
 	mux := testMux()
 	req, _ := http.NewRequest("GET", "http://localhost/unknownrpcpath", nil)
@@ -110,3 +676,150 @@ func TestUnknownRPCPath(t *testing.T) {
 	// Always expecting back a 404 error
 	require.Equal(t, http.StatusNotFound, res.StatusCode, "should always return 404")
 }
+
+//////////////////////////////////////////////////////////////////////////////
+// JSON-RPC over WEBSOCKETS
+
+func newWSServer() *httptest.Server {
+	funcMap := map[string]*RPCFunc{
+		"c": NewWSRPCFunc(func(wsCtx types.WSRPCContext, s string, i int) (string, error) { return "foo", nil }, "s,i"),
+		"d": NewRPCFunc(func(s string) (string, error) { return s, nil }, "s"),
+		"p": NewRPCFunc(func() (string, error) { panic("boom") }, ""),
+	}
+	mux := http.NewServeMux()
+	RegisterWSFuncs(mux, "", funcMap, amino.NewCodec())
+
+	return httptest.NewServer(mux)
+}
+
+func TestWebsocketManagerHandler(t *testing.T) {
+	s := newWSServer()
+	defer s.Close()
+
+	// check upgrader works
+	d := websocket.Dialer{}
+	c, dialResp, err := d.Dial("ws://"+s.Listener.Addr().String()+"/websocket", nil)
+	require.NoError(t, err)
+	defer c.Close()
+
+	if got, want := dialResp.StatusCode, http.StatusSwitchingProtocols; got != want {
+		t.Errorf("dialResp.StatusCode = %d, want %d", got, want)
+	}
+
+	tests := []struct {
+		method  string
+		params  map[string]interface{}
+		wantErr string
+	}{
+		{"c", map[string]interface{}{"s": "a", "i": 10}, ""},
+		// a panic is answered, and the connection is still read
+		{"p", nil, "Internal error"},
+		{"d", map[string]interface{}{"s": "a"}, ""},
+		{"y", nil, "Method not found"},
+	}
+	for i, tt := range tests {
+		req, err := types.MapToRequest(amino.NewCodec(), types.StringID("TestWebsocketManager"), tt.method, tt.params)
+		require.NoError(t, err)
+		require.NoError(t, c.WriteJSON(req))
+
+		var resp types.RPCResponse
+		require.NoError(t, c.ReadJSON(&resp))
+		assert.Equal(t, types.StringID("TestWebsocketManager"), resp.ID, "#%d", i)
+		if tt.wantErr == "" {
+			assert.Nil(t, resp.Error, "#%d: not expecting an error", i)
+		} else if assert.NotNil(t, resp.Error, "#%d: expecting an error", i) {
+			assert.Contains(t, resp.Error.Message, tt.wantErr, "#%d", i)
+		}
+	}
+}
+
+func TestWebsocketNotRPCOverHTTP(t *testing.T) {
+	funcMap := map[string]*RPCFunc{
+		"c": NewWSRPCFunc(func(wsCtx types.WSRPCContext, s string) (string, error) { return s, nil }, "s"),
+	}
+	mux := http.NewServeMux()
+	RegisterRPCFuncs(mux, funcMap, amino.NewCodec())
+
+	body := strings.NewReader(`{"jsonrpc": "2.0", "method": "c", "id": "0", "params": ["a"]}`)
+	req, _ := http.NewRequest("POST", "http://localhost/", body)
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, req)
+
+	recv := new(types.RPCResponse)
+	require.Nil(t, json.Unmarshal(rec.Body.Bytes(), recv))
+	require.NotNil(t, recv.Error)
+	assert.Equal(t, -32601, recv.Error.Code)
+}
+
+func TestNewWSRPCFuncRequiresContext(t *testing.T) {
+	assert.Panics(t, func() { NewWSRPCFunc(func(s string) (string, error) { return s, nil }, "s") })
+	assert.Panics(t, func() { NewWSRPCFunc(func() (string, error) { return "", nil }, "") })
+	assert.Panics(t, func() { NewWSRPCFunc("not a func", "") })
+	assert.NotPanics(t, func() {
+		NewWSRPCFunc(func(wsCtx types.WSRPCContext, s string) (string, error) { return s, nil }, "s")
+	})
+}
+
+func TestWebsocketSubscriptions(t *testing.T) {
+	bus := NewEventBus()
+	mux := http.NewServeMux()
+	RegisterWSFuncs(mux, "", map[string]*RPCFunc{}, amino.NewCodec(), WithEventBus(bus))
+	s := httptest.NewServer(mux)
+	defer s.Close()
+
+	c, _, err := websocket.DefaultDialer.Dial("ws://"+s.Listener.Addr().String()+DefaultWSPath, nil)
+	require.NoError(t, err)
+
+	call := func(id, method string, params map[string]interface{}) types.RPCResponse {
+		req, err := types.MapToRequest(amino.NewCodec(), types.StringID(id), method, params)
+		require.NoError(t, err)
+		require.NoError(t, c.WriteJSON(req))
+		var resp types.RPCResponse
+		require.NoError(t, c.ReadJSON(&resp))
+		return resp
+	}
+
+	resp := call("1", "subscribe", map[string]interface{}{"query": "NewBlock"})
+	require.Nil(t, resp.Error)
+	assert.Equal(t, 1, bus.NumSubscribers("NewBlock"))
+
+	resp = call("2", "subscribe", map[string]interface{}{"query": "NewBlock"})
+	require.NotNil(t, resp.Error)
+	assert.Contains(t, string(resp.Error.Data), "already subscribed")
+
+	bus.Publish("NewBlock", &struct{ Height int }{7})
+	var event types.RPCResponse
+	require.NoError(t, c.ReadJSON(&event))
+	assert.Equal(t, types.StringID("1#event"), event.ID)
+	var result types.ResultEvent
+	require.NoError(t, json.Unmarshal(event.Result, &result))
+	assert.Equal(t, "NewBlock", result.Query)
+	assert.JSONEq(t, `{"Height":"7"}`, string(result.Data))
+
+	resp = call("3", "unsubscribe", map[string]interface{}{"query": "NewBlock"})
+	require.Nil(t, resp.Error)
+	assert.Equal(t, 0, bus.NumSubscribers("NewBlock"))
+
+	// subscriptions are removed when the connection closes
+	resp = call("4", "subscribe", map[string]interface{}{"query": "NewBlock"})
+	require.Nil(t, resp.Error)
+	require.NoError(t, c.Close())
+	for i := 0; i < 100 && bus.NumSubscribers("NewBlock") > 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Equal(t, 0, bus.NumSubscribers("NewBlock"))
+}
+
+func TestWebsocketSubscribeAfterStop(t *testing.T) {
+	bus := NewEventBus()
+	wsc := &wsConnection{remoteAddr: "peer", eventBus: bus, quit: make(chan struct{}), cancel: func() {}}
+
+	// the read routine may still subscribe after the write routine stopped the connection
+	wsc.Stop()
+	_, err := wsc.subscribe(types.WSRPCContext{Request: types.RPCRequest{ID: types.StringID("1")}}, "NewBlock")
+	require.NoError(t, err)
+	for i := 0; i < 100 && bus.NumSubscribers("NewBlock") > 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Equal(t, 0, bus.NumSubscribers("NewBlock"))
+}
@@ -3,84 +3,400 @@ package krpcs
 
 import (
 	"bufio"
+	"context"
 	"encoding/json"
 	"fmt"
 	"net"
 	"net/http"
 	"runtime/debug"
 	"strings"
+	"sync"
 	"time"
 
+	"github.com/pkg/errors"
 	"golang.org/x/net/netutil"
 
 	types "github.com/kooksee/krpc/types"
 )
 
-// Config is an RPC server configuration.
+// Config is an RPC server configuration. It is shared by the functions
+// setting up a server, each reading only some of the fields: the server
+// fields are read by NewServer, StartHTTPServer and StartHTTPAndTLSServer, the
+// JSON-RPC fields by RegisterRPCFuncsWithConfig, and the websocket fields by
+// RegisterWSFuncsWithConfig. The fields are ignored by the other functions.
 type Config struct {
+	// Server fields, read by NewServer, StartHTTPServer and
+	// StartHTTPAndTLSServer.
+
+	// MaxOpenConnections is the maximum number of connections at once. 0
+	// means unlimited.
 	MaxOpenConnections int
+	// MaxBodyBytes is the maximum size of a request body. 0 means 1MB.
+	MaxBodyBytes int64
+	// MaxHeaderBytes is the maximum size of the request headers. 0 means
+	// http.DefaultMaxHeaderBytes.
+	MaxHeaderBytes int
+	// ReadTimeout, WriteTimeout and IdleTimeout are the timeouts of the
+	// http.Server. 0 means the default: 10s, 10s and 60s respectively. A
+	// negative value disables the timeout, which was the behaviour of
+	// servers before these fields were added; long-running handlers may
+	// need it for WriteTimeout.
+	ReadTimeout  time.Duration
+	WriteTimeout time.Duration
+	IdleTimeout  time.Duration
+
+	// JSON-RPC fields, read by RegisterRPCFuncsWithConfig.
+
+	// MaxBatchSize is the maximum number of requests in a JSON-RPC batch.
+	// 0 means unlimited.
+	MaxBatchSize int
+	// MaxBatchWorkers is the number of requests of a batch executed in
+	// parallel. 0 or 1 executes them sequentially.
+	MaxBatchWorkers int
+	// MaxNotificationWorkers is the number of notifications executed in the
+	// background at once; further notifications wait for a free worker.
+	// 0 executes notifications before responding. Server.Shutdown waits for
+	// the notifications running in the background.
+	MaxNotificationWorkers int
+
+	// Fields read by both RegisterRPCFuncsWithConfig and
+	// RegisterWSFuncsWithConfig.
+
+	// Interceptors wrap every call, the first one being the outermost.
+	Interceptors []Interceptor
+	// DisableDiscovery disables the DiscoverMethod and OpenRPCPath, which
+	// serve the OpenRPC document of the functions.
+	DisableDiscovery bool
+	// OpenRPCInfo is the info of the OpenRPC document. The title defaults to
+	// "krpc" and the version to "0.0.0".
+	OpenRPCInfo OpenRPCInfo
+
+	// Websocket fields, read by RegisterWSFuncsWithConfig. 0 means the
+	// default of the respective connection option.
+	WSMaxMessageBytes   int64
+	WSReadBufferSize    int
+	WSWriteBufferSize   int
+	WSWriteChanCapacity int
+	WSReadWait          time.Duration
+	WSWriteWait         time.Duration
+	WSPingPeriod        time.Duration
+	// WSCheckOrigin returns true if the websocket handshake of the request
+	// is accepted, see websocket.Upgrader.CheckOrigin. nil accepts every
+	// origin.
+	WSCheckOrigin func(r *http.Request) bool
+}
+
+// DefaultConfig returns a default configuration for the RPC server.
+func DefaultConfig() Config {
+	return Config{
+		MaxOpenConnections:     0, // unlimited
+		MaxBodyBytes:           defaultMaxBodyBytes,
+		MaxHeaderBytes:         1 << 20, // 1MB
+		ReadTimeout:            defaultReadTimeout,
+		WriteTimeout:           defaultWriteTimeout,
+		IdleTimeout:            defaultIdleTimeout,
+		MaxBatchSize:           100,
+		MaxBatchWorkers:        1,
+		MaxNotificationWorkers: 0,
+		WSMaxMessageBytes:      defaultMaxBodyBytes,
+		WSReadBufferSize:       4096,
+		WSWriteBufferSize:      4096,
+		WSWriteChanCapacity:    defaultWSWriteChanCapacity,
+		WSReadWait:             defaultWSReadWait,
+		WSWriteWait:            defaultWSWriteWait,
+		WSPingPeriod:           defaultWSPingPeriod,
+	}
+}
+
+// Validate returns an error if a limit is negative or the websocket ping
+// period is not shorter than the read wait.
+func (c Config) Validate() error {
+	if c.MaxOpenConnections < 0 {
+		return errors.New("MaxOpenConnections can't be negative")
+	}
+	if c.MaxBodyBytes < 0 {
+		return errors.New("MaxBodyBytes can't be negative")
+	}
+	if c.MaxHeaderBytes < 0 {
+		return errors.New("MaxHeaderBytes can't be negative")
+	}
+	if c.MaxBatchSize < 0 || c.MaxBatchWorkers < 0 || c.MaxNotificationWorkers < 0 {
+		return errors.New("batch and notification limits can't be negative")
+	}
+	if c.WSMaxMessageBytes < 0 || c.WSReadBufferSize < 0 || c.WSWriteBufferSize < 0 || c.WSWriteChanCapacity < 0 {
+		return errors.New("websocket limits can't be negative")
+	}
+	if c.WSReadWait < 0 || c.WSWriteWait < 0 || c.WSPingPeriod < 0 {
+		return errors.New("websocket timeouts can't be negative")
+	}
+	readWait, pingPeriod := c.WSReadWait, c.WSPingPeriod
+	if readWait == 0 {
+		readWait = defaultWSReadWait
+	}
+	if pingPeriod == 0 {
+		pingPeriod = defaultWSPingPeriod
+	}
+	if pingPeriod >= readWait {
+		return errors.Errorf("WSPingPeriod (%v) must be shorter than WSReadWait (%v)", pingPeriod, readWait)
+	}
+	return nil
+}
+
+// maxBodyBytes returns the body limit, applying the default for 0.
+func (c Config) maxBodyBytes() int64 {
+	if c.MaxBodyBytes == 0 {
+		return defaultMaxBodyBytes
+	}
+	return c.MaxBodyBytes
+}
+
+// wsConnOptions returns the connection options for the websocket limits set in
+// c.
+func (c Config) wsConnOptions() []func(*wsConnection) {
+	var options []func(*wsConnection)
+	if c.WSMaxMessageBytes > 0 {
+		options = append(options, ReadLimit(c.WSMaxMessageBytes))
+	}
+	if c.WSWriteChanCapacity > 0 {
+		options = append(options, WriteChanCapacity(c.WSWriteChanCapacity))
+	}
+	if c.WSReadWait > 0 {
+		options = append(options, ReadWait(c.WSReadWait))
+	}
+	if c.WSWriteWait > 0 {
+		options = append(options, WriteWait(c.WSWriteWait))
+	}
+	if c.WSPingPeriod > 0 {
+		options = append(options, PingPeriod(c.WSPingPeriod))
+	}
+	if len(c.Interceptors) > 0 {
+		options = append(options, WithInterceptors(c.Interceptors...))
+	}
+	return options
 }
 
 const (
-	// maxBodyBytes controls the maximum number of bytes the
+	// defaultMaxBodyBytes controls the maximum number of bytes the
 	// server will read parsing the request body.
-	maxBodyBytes = int64(1024 * 1024) // 1MB
+	defaultMaxBodyBytes = int64(1024 * 1024) // 1MB
+
+	defaultReadTimeout  = 10 * time.Second
+	defaultWriteTimeout = 10 * time.Second
+	defaultIdleTimeout  = 60 * time.Second
 )
 
-// StartHTTPServer starts an HTTP server on listenAddr with the given handler.
-// It wraps handler with RecoverAndLogHandler.
-func StartHTTPServer(listenAddr string, handler http.Handler, config Config) net.Listener {
-	parts := strings.SplitN(listenAddr, "://", 2)
-	if len(parts) != 2 {
-		panic(fmt.Sprintf("Invalid listening address %s (use fully formed addresses, including the tcp:// or unix:// prefix)", listenAddr))
+// orDefault returns d, def if d is 0, or 0 (no timeout) if d is negative.
+func orDefault(d, def time.Duration) time.Duration {
+	switch {
+	case d == 0:
+		return def
+	case d < 0:
+		return 0
 	}
+	return d
+}
 
-	proto, addr := parts[0], parts[1]
+// Server is an RPC HTTP(S) server. Unlike http.Serve, it can be shut down
+// gracefully.
+type Server struct {
+	listenAddr string
+	handler    http.Handler
+	config     Config
 
-	logger.Info().Msgf("Starting RPC HTTP server on %s", listenAddr)
-	listener, err := net.Listen(proto, addr)
-	if err != nil {
-		panic(fmt.Sprintf("Failed to listen on %v: %v", listenAddr, err))
+	// serve HTTPS if set
+	certFile string
+	keyFile  string
+
+	// closed with a close frame on Shutdown
+	wsManagers []*WebsocketManager
+
+	mtx        sync.Mutex
+	listener   net.Listener
+	httpServer *http.Server
+
+	// the work requests leave running in the background, see
+	// backgroundHandler
+	background sync.WaitGroup
+}
+
+// NewServer returns a Server listening on listenAddr (e.g. tcp://0.0.0.0:8080
+// or unix:///tmp/rpc.sock) once started. handler is wrapped with
+// RecoverAndLogHandler.
+func NewServer(listenAddr string, handler http.Handler, config Config, options ...func(*Server)) *Server {
+	s := &Server{
+		listenAddr: listenAddr,
+		handler:    handler,
+		config:     config,
+	}
+	for _, option := range options {
+		option(s)
+	}
+	return s
+}
+
+// TLS makes the server serve HTTPS with the given certificate and key files.
+// It should only be used in the constructor - not Goroutine-safe.
+func TLS(certFile, keyFile string) func(*Server) {
+	return func(s *Server) {
+		s.certFile = certFile
+		s.keyFile = keyFile
+	}
+}
+
+// WithWebsocketManagers sets the websocket managers whose connections are
+// closed on Shutdown. Websocket connections are hijacked from the HTTP server,
+// so it does not track them itself.
+// It should only be used in the constructor - not Goroutine-safe.
+func WithWebsocketManagers(wms ...*WebsocketManager) func(*Server) {
+	return func(s *Server) {
+		s.wsManagers = append(s.wsManagers, wms...)
+	}
+}
+
+// Start starts listening and serves the connections in the background.
+func (s *Server) Start() error {
+	if err := s.listen(); err != nil {
+		return err
 	}
+	go func() {
+		if err := s.serve(); err != nil {
+			logger.Error().Err(err).Msg("RPC HTTP server stopped")
+		}
+	}()
+	return nil
+}
 
-	if config.MaxOpenConnections > 0 {
-		listener = netutil.LimitListener(listener, config.MaxOpenConnections)
+// Addr returns the address the server listens on, or nil if it is not
+// started.
+func (s *Server) Addr() net.Addr {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if s.listener == nil {
+		return nil
 	}
+	return s.listener.Addr()
+}
 
-	if err := http.Serve(listener, RecoverAndLogHandler(maxBytesHandler{h: handler, n: maxBodyBytes})); err != nil {
-		logger.Error().Err(err).Msg("RPC HTTP server stopped")
-		panic(err.Error())
+// Shutdown stops accepting connections and waits for the in-flight requests
+// and the notifications running in the background to finish, then closes the
+// websocket connections with a close frame. If ctx is done first, its error is
+// returned.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.mtx.Lock()
+	httpServer := s.httpServer
+	s.mtx.Unlock()
+	if httpServer == nil {
+		return nil
 	}
 
-	return listener
+	logger.Info().Str("addr", s.listenAddr).Msg("Shutting down RPC HTTP server")
+	err := httpServer.Shutdown(ctx)
+	if err == nil {
+		// no request is left to add background work
+		err = s.waitBackground(ctx)
+	}
+	for _, wm := range s.wsManagers {
+		if wmErr := wm.Shutdown(ctx); err == nil {
+			err = wmErr
+		}
+	}
+	return err
 }
 
-// StartHTTPAndTLSServer starts an HTTPS server on listenAddr with the given
-// handler.
-// It wraps handler with RecoverAndLogHandler.
-func StartHTTPAndTLSServer(listenAddr string, handler http.Handler, certFile, keyFile string, config Config) {
-	var proto, addr string
-	parts := strings.SplitN(listenAddr, "://", 2)
-	if len(parts) != 2 {
-		panic(fmt.Sprintf("Invalid listening address %s (use fully formed addresses, including the tcp:// or unix:// prefix)", listenAddr))
+// waitBackground waits for the background work of the requests, or until ctx
+// is done.
+func (s *Server) waitBackground(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		s.background.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
 	}
-	proto, addr = parts[0], parts[1]
+}
 
-	logger.Info().Msgf("Starting RPC HTTPS server on %s (cert: %q, key: %q)", listenAddr, certFile, keyFile)
+func (s *Server) listen() error {
+	if err := s.config.Validate(); err != nil {
+		return errors.Wrap(err, "Invalid config")
+	}
+	parts := strings.SplitN(s.listenAddr, "://", 2)
+	if len(parts) != 2 {
+		return errors.Errorf("Invalid listening address %s (use fully formed addresses, including the tcp:// or unix:// prefix)", s.listenAddr)
+	}
+	proto, addr := parts[0], parts[1]
 
+	if s.certFile != "" {
+		logger.Info().Msgf("Starting RPC HTTPS server on %s (cert: %q, key: %q)", s.listenAddr, s.certFile, s.keyFile)
+	} else {
+		logger.Info().Msgf("Starting RPC HTTP server on %s", s.listenAddr)
+	}
 	listener, err := net.Listen(proto, addr)
 	if err != nil {
-		panic(fmt.Sprintf("Failed to listen on %v: %v", listenAddr, err))
+		return errors.Wrapf(err, "Failed to listen on %v", s.listenAddr)
+	}
+	if s.config.MaxOpenConnections > 0 {
+		listener = netutil.LimitListener(listener, s.config.MaxOpenConnections)
+	}
+
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if s.httpServer != nil {
+		listener.Close() // nolint: errcheck
+		return errors.New("Server already started")
+	}
+	s.listener = listener
+	s.httpServer = &http.Server{
+		Handler:        RecoverAndLogHandler(maxBytesHandler{h: backgroundHandler{h: s.handler, wg: &s.background}, n: s.config.maxBodyBytes()}),
+		MaxHeaderBytes: s.config.MaxHeaderBytes,
+		ReadTimeout:    orDefault(s.config.ReadTimeout, defaultReadTimeout),
+		WriteTimeout:   orDefault(s.config.WriteTimeout, defaultWriteTimeout),
+		IdleTimeout:    orDefault(s.config.IdleTimeout, defaultIdleTimeout),
+	}
+	return nil
+}
+
+// serve blocks until the server stops. It returns nil if it was shut down.
+func (s *Server) serve() error {
+	var err error
+	if s.certFile != "" {
+		err = s.httpServer.ServeTLS(s.listener, s.certFile, s.keyFile)
+	} else {
+		err = s.httpServer.Serve(s.listener)
+	}
+	if err == http.ErrServerClosed {
+		return nil
 	}
+	return err
+}
 
-	if config.MaxOpenConnections > 0 {
-		listener = netutil.LimitListener(listener, config.MaxOpenConnections)
+// StartHTTPServer starts an HTTP server on listenAddr with the given handler
+// and blocks until it stops.
+// It wraps handler with RecoverAndLogHandler.
+//
+// Deprecated: use NewServer, which can be shut down.
+func StartHTTPServer(listenAddr string, handler http.Handler, config Config) error {
+	s := NewServer(listenAddr, handler, config)
+	if err := s.listen(); err != nil {
+		return err
 	}
+	return s.serve()
+}
 
-	if err := http.ServeTLS(listener, RecoverAndLogHandler(maxBytesHandler{h: handler, n: maxBodyBytes}), certFile, keyFile); err != nil {
-		logger.Error().Err(err).Msg("RPC HTTPS server stopped")
-		panic(err.Error())
+// StartHTTPAndTLSServer starts an HTTPS server on listenAddr with the given
+// handler and blocks until it stops.
+// It wraps handler with RecoverAndLogHandler.
+//
+// Deprecated: use NewServer with the TLS option, which can be shut down.
+func StartHTTPAndTLSServer(listenAddr string, handler http.Handler, certFile, keyFile string, config Config) error {
+	s := NewServer(listenAddr, handler, config, TLS(certFile, keyFile))
+	if err := s.listen(); err != nil {
+		return err
 	}
+	return s.serve()
 }
 
 func WriteRPCResponseHTTPError(w http.ResponseWriter, httpCode int, res types.RPCResponse) {
@@ -104,6 +420,17 @@ func WriteRPCResponseHTTP(w http.ResponseWriter, res types.RPCResponse) {
 	w.Write(jsonBytes) // nolint: errcheck, gas
 }
 
+// WriteRPCResponseArrayHTTP writes the responses to a batch request.
+func WriteRPCResponseArrayHTTP(w http.ResponseWriter, res []types.RPCResponse) {
+	jsonBytes, err := json.MarshalIndent(res, "", "  ")
+	if err != nil {
+		panic(err)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(200)
+	w.Write(jsonBytes) // nolint: errcheck, gas
+}
+
 //-----------------------------------------------------------------------------
 
 // Wraps an HTTP handler, adding error logging.
@@ -135,7 +462,7 @@ func RecoverAndLogHandler(handler http.Handler) http.Handler {
 					// For the rest,
 					logger.Error().Str("stack", string(debug.Stack())).Msg("Panic in RPC HTTP handler")
 					rww.WriteHeader(http.StatusInternalServerError)
-					WriteRPCResponseHTTP(rww, types.RPCInternalError("", e.(error)))
+					WriteRPCResponseHTTP(rww, types.RPCInternalError(types.NullID(), errors.Errorf("%v", e)))
 				}
 			}
 
@@ -176,3 +503,33 @@ func (h maxBytesHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	r.Body = http.MaxBytesReader(w, r.Body, h.n)
 	h.h.ServeHTTP(w, r)
 }
+
+// backgroundKey is the request context key of the WaitGroup tracking the work
+// a request leaves running in the background.
+type backgroundKey struct{}
+
+// backgroundHandler passes wg to the handler in the request context, so that
+// the background work of the requests can be waited on.
+type backgroundHandler struct {
+	h  http.Handler
+	wg *sync.WaitGroup
+}
+
+func (h backgroundHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.h.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), backgroundKey{}, h.wg)))
+}
+
+// goBackground runs f in a goroutine, tracked by the WaitGroup of the request
+// context, if any.
+func goBackground(ctx context.Context, f func()) {
+	wg, _ := ctx.Value(backgroundKey{}).(*sync.WaitGroup)
+	if wg != nil {
+		wg.Add(1)
+	}
+	go func() {
+		if wg != nil {
+			defer wg.Done()
+		}
+		f()
+	}()
+}
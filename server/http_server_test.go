@@ -0,0 +1,198 @@
+package krpcs
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tendermint/go-amino"
+
+	types "github.com/kooksee/krpc/types"
+)
+
+func TestServerShutdown(t *testing.T) {
+	entered, release := make(chan struct{}), make(chan struct{})
+	funcMap := map[string]*RPCFunc{
+		"slow": NewRPCFunc(func() (string, error) {
+			close(entered)
+			<-release
+			return "done", nil
+		}, ""),
+	}
+	mux := http.NewServeMux()
+	RegisterRPCFuncs(mux, funcMap, amino.NewCodec())
+	wm := RegisterWSFuncs(mux, "", funcMap, amino.NewCodec())
+	s := NewServer("tcp://127.0.0.1:0", mux, DefaultConfig(), WithWebsocketManagers(wm))
+	require.NoError(t, s.Start())
+	addr := s.Addr().String()
+
+	ws, _, err := websocket.DefaultDialer.Dial("ws://"+addr+DefaultWSPath, nil)
+	require.NoError(t, err)
+	defer ws.Close()
+
+	// an in-flight request
+	responses := make(chan types.RPCResponse, 1)
+	go func() {
+		res, err := http.Post("http://"+addr+"/", "text/json", strings.NewReader(`{"jsonrpc": "2.0", "method": "slow", "id": 1}`))
+		if !assert.NoError(t, err) {
+			return
+		}
+		defer res.Body.Close()
+		var response types.RPCResponse
+		assert.NoError(t, json.NewDecoder(res.Body).Decode(&response))
+		responses <- response
+	}()
+	<-entered
+
+	shutdown := make(chan error, 1)
+	go func() { shutdown <- s.Shutdown(context.Background()) }()
+
+	// the in-flight request is drained
+	select {
+	case <-shutdown:
+		t.Fatal("Shutdown returned before the in-flight request finished")
+	case <-time.After(100 * time.Millisecond):
+	}
+	close(release)
+	response := <-responses
+	assert.Nil(t, response.Error)
+	assert.Equal(t, `"done"`, string(response.Result))
+
+	// the websocket connection is closed with a close frame
+	_, _, err = ws.ReadMessage()
+	assert.True(t, websocket.IsCloseError(err, websocket.CloseGoingAway), "unexpected error %v", err)
+
+	require.NoError(t, <-shutdown)
+	_, err = http.Get("http://" + addr + "/")
+	assert.Error(t, err, "the server no longer accepts connections")
+}
+
+func TestServerShutdownWaitsForNotifications(t *testing.T) {
+	entered, release := make(chan struct{}), make(chan struct{})
+	funcMap := map[string]*RPCFunc{
+		"slow": NewRPCFunc(func() {
+			close(entered)
+			<-release
+		}, ""),
+	}
+	config := DefaultConfig()
+	config.MaxNotificationWorkers = 1
+	mux := http.NewServeMux()
+	RegisterRPCFuncsWithConfig(mux, funcMap, amino.NewCodec(), config)
+	s := NewServer("tcp://127.0.0.1:0", mux, config)
+	require.NoError(t, s.Start())
+
+	res, err := http.Post("http://"+s.Addr().String()+"/", "text/json", strings.NewReader(`{"jsonrpc": "2.0", "method": "slow"}`))
+	require.NoError(t, err)
+	res.Body.Close() // nolint: errcheck
+	assert.Equal(t, http.StatusNoContent, res.StatusCode)
+	<-entered
+
+	shutdown := make(chan error, 1)
+	go func() { shutdown <- s.Shutdown(context.Background()) }()
+	select {
+	case <-shutdown:
+		t.Fatal("Shutdown returned before the notification finished")
+	case <-time.After(100 * time.Millisecond):
+	}
+	close(release)
+	require.NoError(t, <-shutdown)
+}
+
+func TestServerStartErrors(t *testing.T) {
+	assert.Error(t, NewServer("127.0.0.1:0", http.NewServeMux(), DefaultConfig()).Start())
+
+	s := NewServer("tcp://127.0.0.1:0", http.NewServeMux(), DefaultConfig())
+	require.NoError(t, s.Start())
+	defer s.Shutdown(context.Background()) // nolint: errcheck
+	assert.Error(t, s.Start(), "a server can only be started once")
+	assert.Error(t, NewServer("tcp://"+s.Addr().String(), http.NewServeMux(), DefaultConfig()).Start())
+}
+
+func TestServerDefaultTimeouts(t *testing.T) {
+	s := NewServer("tcp://127.0.0.1:0", http.NewServeMux(), Config{WriteTimeout: time.Second, IdleTimeout: -1})
+	require.NoError(t, s.Start())
+	defer s.Shutdown(context.Background()) // nolint: errcheck
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	assert.Equal(t, defaultReadTimeout, s.httpServer.ReadTimeout)
+	assert.Equal(t, time.Second, s.httpServer.WriteTimeout)
+	assert.Equal(t, time.Duration(0), s.httpServer.IdleTimeout, "negative disables the timeout")
+}
+
+func TestConfigValidate(t *testing.T) {
+	assert.NoError(t, DefaultConfig().Validate())
+	assert.NoError(t, Config{}.Validate())
+	assert.NoError(t, Config{ReadTimeout: -1, WriteTimeout: -1, IdleTimeout: -1}.Validate())
+
+	tests := []func(*Config){
+		func(c *Config) { c.MaxBodyBytes = -1 },
+		func(c *Config) { c.MaxBatchSize = -1 },
+		func(c *Config) { c.WSWriteBufferSize = -1 },
+		func(c *Config) { c.WSPingPeriod = c.WSReadWait },
+		func(c *Config) { c.WSReadWait = time.Second },
+	}
+	for i, tt := range tests {
+		config := DefaultConfig()
+		tt(&config)
+		assert.Error(t, config.Validate(), "#%d", i)
+		assert.Error(t, NewServer("tcp://127.0.0.1:0", http.NewServeMux(), config).Start(), "#%d", i)
+	}
+}
+
+func TestServerLimits(t *testing.T) {
+	funcMap := map[string]*RPCFunc{
+		"echo": NewRPCFunc(func(s string) (string, error) { return s, nil }, "s"),
+	}
+	config := DefaultConfig()
+	config.MaxBodyBytes = 100
+	config.WSMaxMessageBytes = 100
+	mux := http.NewServeMux()
+	RegisterRPCFuncsWithConfig(mux, funcMap, amino.NewCodec(), config)
+	RegisterWSFuncsWithConfig(mux, "", funcMap, amino.NewCodec(), config)
+	s := NewServer("tcp://127.0.0.1:0", mux, config)
+	require.NoError(t, s.Start())
+	defer s.Shutdown(context.Background()) // nolint: errcheck
+	addr := s.Addr().String()
+
+	long := strings.Repeat("a", 100)
+	res, err := http.Post("http://"+addr+"/", "text/json", strings.NewReader(`{"jsonrpc": "2.0", "method": "echo", "id": 1, "params": ["`+long+`"]}`))
+	require.NoError(t, err)
+	defer res.Body.Close()
+	var response types.RPCResponse
+	require.NoError(t, json.NewDecoder(res.Body).Decode(&response))
+	require.NotNil(t, response.Error)
+	assert.Contains(t, string(response.Error.Data), "too large")
+
+	ws, _, err := websocket.DefaultDialer.Dial("ws://"+addr+DefaultWSPath, nil)
+	require.NoError(t, err)
+	defer ws.Close()
+	require.NoError(t, ws.WriteJSON(types.RPCRequest{JSONRPC: "2.0", ID: types.IntID(1), Method: "echo", Params: json.RawMessage(`["` + long + `"]`)}))
+	_, _, err = ws.ReadMessage()
+	assert.True(t, websocket.IsCloseError(err, websocket.CloseMessageTooBig), "unexpected error %v", err)
+}
+
+func TestServerWSCheckOrigin(t *testing.T) {
+	config := DefaultConfig()
+	config.WSCheckOrigin = func(r *http.Request) bool { return r.Header.Get("Origin") == "http://trusted" }
+	mux := http.NewServeMux()
+	RegisterWSFuncsWithConfig(mux, "", map[string]*RPCFunc{}, amino.NewCodec(), config)
+	s := httptest.NewServer(mux)
+	defer s.Close()
+	url := "ws://" + s.Listener.Addr().String() + DefaultWSPath
+
+	ws, _, err := websocket.DefaultDialer.Dial(url, http.Header{"Origin": {"http://trusted"}})
+	require.NoError(t, err)
+	ws.Close()
+
+	_, res, err := websocket.DefaultDialer.Dial(url, http.Header{"Origin": {"http://evil"}})
+	require.Error(t, err)
+	assert.Equal(t, http.StatusForbidden, res.StatusCode)
+}
@@ -0,0 +1,105 @@
+package krpcs
+
+import (
+	"context"
+	"net/http"
+	"reflect"
+
+	types "github.com/kooksee/krpc/types"
+)
+
+// Transport identifies how a call reached the server.
+type Transport string
+
+const (
+	// TransportJSONRPC is a JSON-RPC request (or batch element) over HTTP.
+	TransportJSONRPC Transport = "jsonrpc"
+	// TransportURI is a request to the /<method> HTTP endpoint.
+	TransportURI Transport = "uri"
+	// TransportWebsocket is a JSON-RPC request over a websocket connection.
+	TransportWebsocket Transport = "websocket"
+)
+
+// CallInfo describes an invocation of an RPC function to interceptors.
+type CallInfo struct {
+	Method    string
+	Transport Transport
+	// ID is empty for notifications and URI requests.
+	ID         types.JSONRPCID
+	RemoteAddr string
+	// HTTPRequest is the request carrying the call. For websocket calls it is
+	// the upgrade request of the connection, and may be nil.
+	HTTPRequest *http.Request
+	// ArgNames and Args are the named arguments of the function, decoded from
+	// the params. The context.Context and types.WSRPCContext are not included.
+	// Args must not be modified.
+	ArgNames []string
+	Args     []interface{}
+}
+
+// Invoker calls the RPC function described by info and returns its result.
+type Invoker func(ctx context.Context, info *CallInfo) (interface{}, error)
+
+// Interceptor wraps the invocation of an RPC function. It may inspect the call,
+// alter ctx, return early without calling next, or post-process the result.
+// An error returned by an interceptor is sent to the client like an error of
+// the function.
+type Interceptor func(ctx context.Context, info *CallInfo, next Invoker) (interface{}, error)
+
+// ChainInterceptors returns an Interceptor which runs interceptors in order,
+// the first one being the outermost. It returns nil if no interceptors are
+// given.
+func ChainInterceptors(interceptors ...Interceptor) Interceptor {
+	switch len(interceptors) {
+	case 0:
+		return nil
+	case 1:
+		return interceptors[0]
+	}
+	return func(ctx context.Context, info *CallInfo, next Invoker) (interface{}, error) {
+		return interceptors[0](ctx, info, chainedInvoker(interceptors[1:], next))
+	}
+}
+
+func chainedInvoker(interceptors []Interceptor, next Invoker) Invoker {
+	if len(interceptors) == 0 {
+		return next
+	}
+	return func(ctx context.Context, info *CallInfo) (interface{}, error) {
+		return interceptors[0](ctx, info, chainedInvoker(interceptors[1:], next))
+	}
+}
+
+// newCallInfo returns the CallInfo of a call of f with args, which may include
+// the types.WSRPCContext but not the context.Context.
+func newCallInfo(f *RPCFunc, transport Transport, id types.JSONRPCID, remoteAddr, method string, r *http.Request, args []reflect.Value) *CallInfo {
+	named := args
+	if f.ws && len(named) > 0 {
+		named = named[1:]
+	}
+	values := make([]interface{}, len(named))
+	for i, arg := range named {
+		values[i] = arg.Interface()
+	}
+	return &CallInfo{
+		Method:      method,
+		Transport:   transport,
+		ID:          id,
+		RemoteAddr:  remoteAddr,
+		HTTPRequest: r,
+		ArgNames:    f.argNames,
+		Args:        values,
+	}
+}
+
+// invoke calls f with args through interceptor, which may be nil.
+func (f *RPCFunc) invoke(ctx context.Context, info *CallInfo, args []reflect.Value, interceptor Interceptor) (interface{}, error) {
+	ctx = withCallInfo(ctx, info.ID, info.RemoteAddr, info.Method)
+	invoker := func(ctx context.Context, info *CallInfo) (interface{}, error) {
+		return unreflectResult(f.call(ctx, args))
+	}
+	if interceptor == nil {
+		return invoker(ctx, info)
+	}
+	return interceptor(ctx, info, invoker)
+}
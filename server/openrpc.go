@@ -0,0 +1,314 @@
+package krpcs
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tendermint/go-amino"
+
+	types "github.com/kooksee/krpc/types"
+)
+
+// DiscoverMethod is the method returning the OpenRPC document of the server.
+const DiscoverMethod = "rpc.discover"
+
+// OpenRPCPath is the path the OpenRPC document of the server is served on.
+const OpenRPCPath = "/openrpc.json"
+
+// OpenRPCVersion is the version of the OpenRPC specification of the documents.
+const OpenRPCVersion = "1.2.6"
+
+// OpenRPCDocument describes RPC functions following the OpenRPC specification
+// (https://spec.open-rpc.org).
+type OpenRPCDocument struct {
+	OpenRPC    string             `json:"openrpc"`
+	Info       OpenRPCInfo        `json:"info"`
+	Methods    []OpenRPCMethod    `json:"methods"`
+	Components *OpenRPCComponents `json:"components,omitempty"`
+}
+
+// OpenRPCInfo is the metadata of the API in an OpenRPC document.
+type OpenRPCInfo struct {
+	Title       string `json:"title"`
+	Description string `json:"description,omitempty"`
+	Version     string `json:"version"`
+}
+
+// OpenRPCMethod describes an RPC function.
+type OpenRPCMethod struct {
+	Name   string                     `json:"name"`
+	Params []OpenRPCContentDescriptor `json:"params"`
+	Result OpenRPCContentDescriptor   `json:"result"`
+	Errors []OpenRPCError             `json:"errors,omitempty"`
+	// WebsocketOnly is set for functions which can only be called over
+	// websockets.
+	WebsocketOnly bool `json:"x-websocket-only,omitempty"`
+}
+
+// OpenRPCContentDescriptor describes a parameter or result.
+type OpenRPCContentDescriptor struct {
+	Name     string      `json:"name"`
+	Required bool        `json:"required,omitempty"`
+	Schema   *JSONSchema `json:"schema"`
+}
+
+// OpenRPCError describes an error a method may return.
+type OpenRPCError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+// OpenRPCComponents holds the schemas referred to by the methods.
+type OpenRPCComponents struct {
+	Schemas map[string]*JSONSchema `json:"schemas,omitempty"`
+}
+
+// JSONSchema is the JSON Schema of a value, as far as used by OpenRPC
+// documents.
+type JSONSchema struct {
+	Ref                  string                 `json:"$ref,omitempty"`
+	Type                 string                 `json:"type,omitempty"`
+	Format               string                 `json:"format,omitempty"`
+	Pattern              string                 `json:"pattern,omitempty"`
+	ContentEncoding      string                 `json:"contentEncoding,omitempty"`
+	Items                *JSONSchema            `json:"items,omitempty"`
+	MinItems             *int                   `json:"minItems,omitempty"`
+	MaxItems             *int                   `json:"maxItems,omitempty"`
+	Properties           map[string]*JSONSchema `json:"properties,omitempty"`
+	AdditionalProperties *JSONSchema            `json:"additionalProperties,omitempty"`
+	Default              json.RawMessage        `json:"default,omitempty"`
+}
+
+// NewOpenRPCDocument returns the OpenRPC document of the functions in funcMap,
+// whose params and results are encoded with cdc. The schemas follow the amino
+// JSON encoding, e.g. 64 bit integers are strings. The errors of a method are
+// the invalid params error, the internal error and the errors registered with
+// types.RegisterError. The DiscoverMethod is not included.
+func NewOpenRPCDocument(funcMap map[string]*RPCFunc, cdc *amino.Codec, info OpenRPCInfo) *OpenRPCDocument {
+	g := &schemaGenerator{
+		refs:    make(map[reflect.Type]string),
+		schemas: make(map[string]*JSONSchema),
+	}
+	var appErrors []OpenRPCError
+	for _, code := range types.RegisteredCodes() {
+		if err := types.RegisteredError(code); err != nil {
+			appErrors = append(appErrors, OpenRPCError{Code: code, Message: err.Error()})
+		}
+	}
+
+	names := make([]string, 0, len(funcMap))
+	for name := range funcMap {
+		if name != DiscoverMethod {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	doc := &OpenRPCDocument{
+		OpenRPC: OpenRPCVersion,
+		Info:    info,
+		Methods: make([]OpenRPCMethod, len(names)),
+	}
+	for i, name := range names {
+		rpcFunc := funcMap[name]
+		method := OpenRPCMethod{
+			Name:          name,
+			Params:        []OpenRPCContentDescriptor{},
+			Result:        OpenRPCContentDescriptor{Name: "result", Schema: &JSONSchema{Type: "null"}},
+			WebsocketOnly: rpcFunc.ws,
+		}
+		for j, param := range rpcFunc.Params() {
+			schema := g.schema(param.Type)
+			if param.Default != "" {
+				schema = defaultSchema(schema, rpcFunc, cdc, j)
+			}
+			method.Params = append(method.Params, OpenRPCContentDescriptor{
+				Name:     param.Name,
+				Required: param.Required,
+				Schema:   schema,
+			})
+		}
+		if t := rpcFunc.Result(); t != nil {
+			method.Result.Schema = g.schema(t)
+		}
+		if len(method.Params) > 0 {
+			method.Errors = append(method.Errors, OpenRPCError{Code: types.CodeInvalidParams, Message: "Invalid params"})
+		}
+		method.Errors = append(method.Errors, OpenRPCError{Code: types.CodeInternalError, Message: "Internal error"})
+		method.Errors = append(method.Errors, appErrors...)
+		doc.Methods[i] = method
+	}
+	if len(g.schemas) > 0 {
+		doc.Components = &OpenRPCComponents{Schemas: g.schemas}
+	}
+	return doc
+}
+
+// defaultSchema returns a copy of schema with the default of the i-th
+// parameter of f, or schema if the default can't be encoded.
+func defaultSchema(schema *JSONSchema, f *RPCFunc, cdc *amino.Codec, i int) *JSONSchema {
+	val, err := f.defaultArg(cdc, i)
+	if err != nil {
+		return schema
+	}
+	def, err := cdc.MarshalJSON(val.Interface())
+	if err != nil {
+		return schema
+	}
+	withDefault := *schema
+	withDefault.Default = def
+	return &withDefault
+}
+
+var (
+	timeType       = reflect.TypeOf(time.Time{})
+	bytesType      = reflect.TypeOf([]byte(nil))
+	rawMessageType = reflect.TypeOf(json.RawMessage(nil))
+)
+
+// schemaGenerator generates the schemas of Go types, keeping the schemas of
+// named structs as components.
+type schemaGenerator struct {
+	refs    map[reflect.Type]string
+	schemas map[string]*JSONSchema
+}
+
+// schema returns the JSON schema of the amino JSON encoding of t.
+func (g *schemaGenerator) schema(t reflect.Type) *JSONSchema {
+	switch {
+	case t == rawMessageType:
+		// sent as is, see types.NewRPCSuccessResponse
+		return &JSONSchema{}
+	case t == timeType:
+		return &JSONSchema{Type: "string", Format: "date-time"}
+	case t.Kind() == reflect.Slice && t.Elem().Kind() == reflect.Uint8,
+		t.Kind() == reflect.Array && t.Elem().Kind() == reflect.Uint8:
+		return &JSONSchema{Type: "string", ContentEncoding: "base64"}
+	}
+	switch t.Kind() {
+	case reflect.Bool:
+		return &JSONSchema{Type: "boolean"}
+	case reflect.Int, reflect.Int64:
+		return &JSONSchema{Type: "string", Pattern: "^-?[0-9]+$"}
+	case reflect.Uint, reflect.Uint64:
+		return &JSONSchema{Type: "string", Pattern: "^[0-9]+$"}
+	case reflect.Int8, reflect.Int16, reflect.Int32, reflect.Uint8, reflect.Uint16, reflect.Uint32:
+		return &JSONSchema{Type: "integer"}
+	case reflect.Float32, reflect.Float64:
+		return &JSONSchema{Type: "number"}
+	case reflect.String:
+		return &JSONSchema{Type: "string"}
+	case reflect.Ptr:
+		return g.schema(t.Elem())
+	case reflect.Slice:
+		return &JSONSchema{Type: "array", Items: g.schema(t.Elem())}
+	case reflect.Array:
+		n := t.Len()
+		return &JSONSchema{Type: "array", Items: g.schema(t.Elem()), MinItems: &n, MaxItems: &n}
+	case reflect.Map:
+		return &JSONSchema{Type: "object", AdditionalProperties: g.schema(t.Elem())}
+	case reflect.Struct:
+		if t.Name() == "" {
+			return g.structSchema(t)
+		}
+		return &JSONSchema{Ref: "#/components/schemas/" + g.ref(t)}
+	}
+	// interfaces and others may be anything
+	return &JSONSchema{}
+}
+
+// ref returns the name of the component schema of the named struct t,
+// generating it if needed.
+func (g *schemaGenerator) ref(t reflect.Type) string {
+	if name, ok := g.refs[t]; ok {
+		return name
+	}
+	name := t.Name()
+	if _, ok := g.schemas[name]; ok {
+		// qualify types of different packages with the same name
+		name = strings.Replace(t.String(), ".", "_", -1)
+	}
+	g.refs[t] = name
+	g.schemas[name] = nil // placeholder for recursive types
+	g.schemas[name] = g.structSchema(t)
+	return name
+}
+
+// structSchema returns the schema of the struct t, whose fields are named like
+// in amino JSON.
+func (g *schemaGenerator) structSchema(t reflect.Type) *JSONSchema {
+	schema := &JSONSchema{Type: "object", Properties: make(map[string]*JSONSchema)}
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if field.PkgPath != "" { // unexported
+			continue
+		}
+		name := field.Name
+		if tag := field.Tag.Get("json"); tag == "-" {
+			continue
+		} else if tag = strings.Split(tag, ",")[0]; tag != "" {
+			name = tag
+		}
+		schema.Properties[name] = g.schema(field.Type)
+	}
+	return schema
+}
+
+// discovery serves the OpenRPC document of funcMap, generating it once when
+// first requested.
+type discovery struct {
+	funcMap map[string]*RPCFunc
+	cdc     *amino.Codec
+	info    OpenRPCInfo
+
+	once sync.Once
+	doc  json.RawMessage
+	err  error
+}
+
+func newDiscovery(funcMap map[string]*RPCFunc, cdc *amino.Codec, info OpenRPCInfo) *discovery {
+	if info.Title == "" {
+		info.Title = "krpc"
+	}
+	if info.Version == "" {
+		info.Version = "0.0.0"
+	}
+	return &discovery{funcMap: funcMap, cdc: cdc, info: info}
+}
+
+func (d *discovery) document() (json.RawMessage, error) {
+	d.once.Do(func() {
+		d.doc, d.err = json.Marshal(NewOpenRPCDocument(d.funcMap, d.cdc, d.info))
+	})
+	return d.doc, d.err
+}
+
+// withDiscovery returns a copy of funcMap with the DiscoverMethod, unless
+// funcMap has one already.
+func (d *discovery) withDiscovery(funcMap map[string]*RPCFunc) map[string]*RPCFunc {
+	if _, ok := funcMap[DiscoverMethod]; ok {
+		return funcMap
+	}
+	withDiscover := make(map[string]*RPCFunc, len(funcMap)+1)
+	for name, rpcFunc := range funcMap {
+		withDiscover[name] = rpcFunc
+	}
+	withDiscover[DiscoverMethod] = NewRPCFunc(d.document, "")
+	return withDiscover
+}
+
+// ServeHTTP writes the OpenRPC document.
+func (d *discovery) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	doc, err := d.document()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(doc) // nolint: errcheck, gas
+}
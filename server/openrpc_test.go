@@ -0,0 +1,202 @@
+package krpcs
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tendermint/go-amino"
+
+	types "github.com/kooksee/krpc/types"
+)
+
+type block struct {
+	Height int64     `json:"height"`
+	Time   time.Time `json:"time"`
+	Hash   []byte    `json:"hash"`
+	Parent *block    `json:"parent"`
+	Txs    []tx      `json:"txs"`
+	secret string    // nolint: unused, structcheck
+}
+
+type tx struct {
+	Index uint32          `json:"index"`
+	Data  [4]byte         `json:"data"`
+	Tags  map[string]bool `json:"tags"`
+	Any   interface{}     `json:"any"`
+}
+
+type blockParams struct {
+	Height uint64 `json:"height" rpc:"required"`
+	Limit  int    `json:"limit" rpc:"default=20"`
+	Ratio  float64
+}
+
+func openRPCFuncs() map[string]*RPCFunc {
+	return map[string]*RPCFunc{
+		"block":     NewRPCFunc(func(ctx context.Context, p blockParams) (*block, error) { return nil, nil }, ""),
+		"ping":      NewRPCFunc(func() error { return nil }, ""),
+		"subscribe": NewWSRPCFunc(func(wsCtx types.WSRPCContext, query string) {}, "query?"),
+	}
+}
+
+func TestNewOpenRPCDocument(t *testing.T) {
+	funcMap := openRPCFuncs()
+	funcMap[DiscoverMethod] = NewRPCFunc(func() {}, "")
+	doc := NewOpenRPCDocument(funcMap, amino.NewCodec(), OpenRPCInfo{Title: "test", Version: "1.0.0"})
+	b, err := json.Marshal(doc)
+	require.NoError(t, err)
+
+	var got map[string]interface{}
+	require.NoError(t, json.Unmarshal(b, &got))
+	var want map[string]interface{}
+	require.NoError(t, json.Unmarshal([]byte(`{
+		"openrpc": "1.2.6",
+		"info": {"title": "test", "version": "1.0.0"},
+		"methods": [
+			{
+				"name": "block",
+				"params": [
+					{"name": "height", "required": true, "schema": {"type": "string", "pattern": "^[0-9]+$"}},
+					{"name": "limit", "schema": {"type": "string", "pattern": "^-?[0-9]+$", "default": "20"}},
+					{"name": "Ratio", "schema": {"type": "number"}}
+				],
+				"result": {"name": "result", "schema": {"$ref": "#/components/schemas/block"}},
+				"errors": [
+					{"code": -32602, "message": "Invalid params"},
+					{"code": -32603, "message": "Internal error"}
+				]
+			},
+			{
+				"name": "ping",
+				"params": [],
+				"result": {"name": "result", "schema": {"type": "null"}},
+				"errors": [{"code": -32603, "message": "Internal error"}]
+			},
+			{
+				"name": "subscribe",
+				"params": [{"name": "query", "schema": {"type": "string"}}],
+				"result": {"name": "result", "schema": {"type": "null"}},
+				"errors": [
+					{"code": -32602, "message": "Invalid params"},
+					{"code": -32603, "message": "Internal error"}
+				],
+				"x-websocket-only": true
+			}
+		],
+		"components": {
+			"schemas": {
+				"block": {
+					"type": "object",
+					"properties": {
+						"height": {"type": "string", "pattern": "^-?[0-9]+$"},
+						"time": {"type": "string", "format": "date-time"},
+						"hash": {"type": "string", "contentEncoding": "base64"},
+						"parent": {"$ref": "#/components/schemas/block"},
+						"txs": {"type": "array", "items": {"$ref": "#/components/schemas/tx"}}
+					}
+				},
+				"tx": {
+					"type": "object",
+					"properties": {
+						"index": {"type": "integer"},
+						"data": {"type": "string", "contentEncoding": "base64"},
+						"tags": {"type": "object", "additionalProperties": {"type": "boolean"}},
+						"any": {}
+					}
+				}
+			}
+		}
+	}`), &want))
+	assert.Equal(t, want, got)
+
+	// raw JSON is sent as is, so may be anything
+	doc = NewOpenRPCDocument(map[string]*RPCFunc{
+		"raw":    NewRPCFunc(func() (json.RawMessage, error) { return nil, nil }, ""),
+		"rawPtr": NewRPCFunc(func(p *json.RawMessage) (*json.RawMessage, error) { return p, nil }, "p"),
+	}, amino.NewCodec(), OpenRPCInfo{})
+	require.Len(t, doc.Methods, 2)
+	assert.Equal(t, &JSONSchema{}, doc.Methods[0].Result.Schema)
+	assert.Equal(t, &JSONSchema{}, doc.Methods[1].Params[0].Schema)
+	assert.Equal(t, &JSONSchema{}, doc.Methods[1].Result.Schema)
+}
+
+func TestOpenRPCDiscovery(t *testing.T) {
+	mux := http.NewServeMux()
+	config := DefaultConfig()
+	config.OpenRPCInfo = OpenRPCInfo{Title: "test", Version: "1.0.0"}
+	RegisterRPCFuncsWithConfig(mux, openRPCFuncs(), amino.NewCodec(), config)
+
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest("GET", OpenRPCPath, nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "application/json", rec.Header().Get("Content-Type"))
+	served := rec.Body.String()
+
+	body := strings.NewReader(`{"jsonrpc": "2.0", "method": "rpc.discover", "id": 1}`)
+	rec = httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest("POST", "/", body))
+	var recv types.RPCResponse
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &recv))
+	require.Nil(t, recv.Error)
+	assert.JSONEq(t, served, string(recv.Result))
+
+	var doc OpenRPCDocument
+	require.NoError(t, json.Unmarshal(recv.Result, &doc))
+	assert.Equal(t, config.OpenRPCInfo, doc.Info)
+	require.Len(t, doc.Methods, 3, "the DiscoverMethod is not described")
+
+	// websocket
+	s := httptest.NewServer(mux)
+	defer s.Close()
+	wm := RegisterWSFuncsWithConfig(mux, "", openRPCFuncs(), amino.NewCodec(), config)
+	defer wm.Shutdown(context.Background()) // nolint: errcheck
+	c, _, err := websocket.DefaultDialer.Dial("ws://"+s.Listener.Addr().String()+DefaultWSPath, nil)
+	require.NoError(t, err)
+	defer c.Close()
+	require.NoError(t, c.WriteJSON(types.RPCRequest{JSONRPC: "2.0", ID: types.IntID(1), Method: DiscoverMethod}))
+	recv = types.RPCResponse{}
+	require.NoError(t, c.ReadJSON(&recv))
+	require.Nil(t, recv.Error)
+	assert.JSONEq(t, served, string(recv.Result))
+}
+
+func TestOpenRPCDiscoveryDisabled(t *testing.T) {
+	mux := http.NewServeMux()
+	config := DefaultConfig()
+	config.DisableDiscovery = true
+	RegisterRPCFuncsWithConfig(mux, openRPCFuncs(), amino.NewCodec(), config)
+
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest("GET", OpenRPCPath, nil))
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+
+	body := strings.NewReader(`{"jsonrpc": "2.0", "method": "rpc.discover", "id": 1}`)
+	rec = httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest("POST", "/", body))
+	blob, err := ioutil.ReadAll(rec.Body)
+	require.NoError(t, err)
+	var recv types.RPCResponse
+	require.NoError(t, json.Unmarshal(blob, &recv))
+	assert.True(t, types.IsMethodNotFound(recv.Error), "unexpected response %s", blob)
+
+	// a DiscoverMethod of the funcMap is kept
+	funcMap := openRPCFuncs()
+	funcMap[DiscoverMethod] = NewRPCFunc(func() string { return "custom" }, "")
+	mux = http.NewServeMux()
+	RegisterRPCFuncs(mux, funcMap, amino.NewCodec())
+	body = strings.NewReader(`{"jsonrpc": "2.0", "method": "rpc.discover", "id": 1}`)
+	rec = httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest("POST", "/", body))
+	recv = types.RPCResponse{}
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &recv))
+	assert.Equal(t, `"custom"`, string(recv.Result))
+}
@@ -0,0 +1,197 @@
+package krpcs
+
+import (
+	"reflect"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/tendermint/go-amino"
+
+	types "github.com/kooksee/krpc/types"
+)
+
+// paramMode declares whether a parameter may be omitted.
+type paramMode int
+
+const (
+	// paramPlain parameters get their zero value if omitted from named
+	// params, but must be given in positional params.
+	paramPlain paramMode = iota
+	// paramRequired parameters ("name!") must always be given.
+	paramRequired
+	// paramOptional parameters ("name?" or "name=default") may always be
+	// omitted.
+	paramOptional
+)
+
+// paramSpec is the declaration of a parameter in the args of an RPCFunc.
+type paramSpec struct {
+	mode paramMode
+	// value of an omitted optional parameter, in the syntax of URI params.
+	// Empty means the zero value.
+	def string
+	// validators of the value, declared by the validate tag of a params
+	// struct field.
+	validators []validator
+}
+
+// parseParams splits the comma separated parameter declarations of args into
+// names and specs, trimming whitespace. A declaration is a name, optionally
+// followed by "!" (required), "?" (optional) or "=default" (optional with a
+// default value). Names must not be empty or repeated.
+func parseParams(args string) ([]string, []paramSpec, error) {
+	if strings.TrimSpace(args) == "" {
+		return nil, nil, nil
+	}
+	decls := strings.Split(args, ",")
+	names := make([]string, len(decls))
+	specs := make([]paramSpec, len(decls))
+	seen := make(map[string]bool, len(decls))
+	for i, decl := range decls {
+		name := strings.TrimSpace(decl)
+		var spec paramSpec
+		if j := strings.Index(name, "="); j >= 0 {
+			spec = paramSpec{mode: paramOptional, def: strings.TrimSpace(name[j+1:])}
+			name = strings.TrimSpace(name[:j])
+			if spec.def == "" {
+				return nil, nil, errors.Errorf("default value of argument %q in %q is empty", name, args)
+			}
+		} else if strings.HasSuffix(name, "!") {
+			spec.mode = paramRequired
+			name = strings.TrimSpace(strings.TrimSuffix(name, "!"))
+		} else if strings.HasSuffix(name, "?") {
+			spec.mode = paramOptional
+			name = strings.TrimSpace(strings.TrimSuffix(name, "?"))
+		}
+		if name == "" {
+			return nil, nil, errors.Errorf("argument name #%d in %q is empty", i, args)
+		}
+		if seen[name] {
+			return nil, nil, errors.Errorf("argument name %q is repeated in %q", name, args)
+		}
+		seen[name] = true
+		names[i] = name
+		specs[i] = spec
+	}
+	return names, specs, nil
+}
+
+// checkDefaults returns an error if a default value of f can't be parsed.
+func (f *RPCFunc) checkDefaults() error {
+	cdc := amino.NewCodec()
+	for i, spec := range f.params {
+		if spec.def == "" {
+			continue
+		}
+		if _, err := f.defaultArg(cdc, i); err != nil {
+			return errors.Wrapf(err, "invalid default value of argument %q", f.argNames[i])
+		}
+	}
+	return nil
+}
+
+// defaultArg returns the value of the i-th named parameter if it is omitted.
+func (f *RPCFunc) defaultArg(cdc *amino.Codec, i int) (reflect.Value, error) {
+	argType := f.args[i+f.argsOffset()]
+	def := f.params[i].def
+	if def == "" {
+		return reflect.Zero(argType), nil
+	}
+	v, err, ok := nonJSONStringToArg(cdc, argType, def)
+	if err != nil || ok {
+		return v, err
+	}
+	return jsonStringToArg(cdc, argType, def)
+}
+
+// missingArg returns the value of the i-th named parameter if it is omitted
+// from named params, or an error if it is required.
+func (f *RPCFunc) missingArg(cdc *amino.Codec, i int) (reflect.Value, error) {
+	if f.params[i].mode == paramRequired {
+		return reflect.Value{}, errMissingParam
+	}
+	return f.defaultArg(cdc, i)
+}
+
+var errMissingParam = errors.New("is required")
+
+// optionalFrom reports whether the named parameters from the i-th on are
+// optional, so that positional params may end before them.
+func (f *RPCFunc) optionalFrom(i int) bool {
+	for ; i < len(f.params); i++ {
+		if f.params[i].mode != paramOptional {
+			return false
+		}
+	}
+	return true
+}
+
+// invalidFieldsError lists the invalid parameters of a request. It is
+// answered with an invalid params error having the fields as data.
+type invalidFieldsError struct {
+	fields []types.FieldError
+}
+
+func (e *invalidFieldsError) add(field string, err error) {
+	e.fields = append(e.fields, types.FieldError{Field: field, Message: err.Error()})
+}
+
+func (e *invalidFieldsError) Error() string {
+	msgs := make([]string, len(e.fields))
+	for i, field := range e.fields {
+		msgs[i] = field.Field + " " + field.Message
+	}
+	return "Invalid params: " + strings.Join(msgs, ", ")
+}
+
+// invalidParamsResponse returns the response for params which could not be
+// converted to arguments. Invalid fields are sent as data.
+func invalidParamsResponse(id types.JSONRPCID, err error) types.RPCResponse {
+	if fieldsErr, ok := errors.Cause(err).(*invalidFieldsError); ok {
+		return types.RPCInvalidFieldsError(id, fieldsErr.fields)
+	}
+	return types.RPCInvalidParamsError(id, err)
+}
+
+// Param describes a named parameter of an RPCFunc.
+type Param struct {
+	Name string
+	Type reflect.Type
+	// Required is true if the parameter must always be given, and Optional is
+	// true if it may always be omitted. Other parameters get their zero value
+	// if omitted from named params, but must be given in positional params.
+	Required bool
+	Optional bool
+	// Default is the value of an omitted optional parameter, in the syntax of
+	// URI params. Empty means the zero value.
+	Default string
+}
+
+// Params returns the named parameters of f, in order.
+func (f *RPCFunc) Params() []Param {
+	params := make([]Param, len(f.argNames))
+	for i, name := range f.argNames {
+		params[i] = Param{
+			Name:     name,
+			Type:     f.args[i+f.argsOffset()],
+			Required: f.params[i].mode == paramRequired,
+			Optional: f.params[i].mode == paramOptional,
+			Default:  f.params[i].def,
+		}
+	}
+	return params
+}
+
+// Result returns the type of the result of f, or nil if f only returns an
+// error or nothing.
+func (f *RPCFunc) Result() reflect.Type {
+	if len(f.returns) == 0 || (len(f.returns) == 1 && f.returns[0] == errorType) {
+		return nil
+	}
+	return f.returns[0]
+}
+
+// WebsocketOnly returns true if f can only be called over websockets.
+func (f *RPCFunc) WebsocketOnly() bool {
+	return f.ws
+}
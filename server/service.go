@@ -0,0 +1,239 @@
+package krpcs
+
+import (
+	"reflect"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/pkg/errors"
+)
+
+// FuncMap maps method names to RPC functions. It can be passed wherever a
+// map[string]*RPCFunc is expected.
+type FuncMap map[string]*RPCFunc
+
+// RegisterService adds the exported methods of svc to m, named
+// namespace_methodName (e.g. "eth_getBalance" for the method GetBalance of a
+// service registered in the "eth" namespace), or just methodName if namespace
+// is empty.
+//
+// Each method may take a context.Context and then a types.WSRPCContext, which
+// makes it websocket only, followed by nothing or a single params struct (a
+// struct or pointer to a struct with exported fields, which is not a
+// json.Unmarshaler). The exported fields of the params struct are the
+// parameters of the method, named by their json tag or else the field name.
+// A field is skipped if its json tag is "-". The rpc tag declares whether a
+// field may be omitted, like the args of NewRPCFunc: `rpc:"required"`,
+// `rpc:"optional"` or `rpc:"default=20"`. The validate tag declares checks of
+// the value, e.g. `validate:"required,min=1,max=100,regexp=hex"`, see
+// parseValidators; requests with invalid params are answered with an invalid
+// params error listing each invalid field. The methods must return values like
+// the functions of NewRPCFunc.
+//
+// Exported methods which are not RPC functions, e.g. helpers with other
+// signatures, must be skipped with the SkipMethods option.
+//
+// It returns an error, leaving m unchanged, if svc has no exported methods to
+// register, a method has another signature, or a method name is already in m.
+func (m FuncMap) RegisterService(namespace string, svc interface{}, options ...func(*serviceOptions)) error {
+	opts := serviceOptions{skip: make(map[string]bool)}
+	for _, option := range options {
+		option(&opts)
+	}
+	v := reflect.ValueOf(svc)
+	if !v.IsValid() {
+		return errors.Errorf("service %T has no exported methods", svc)
+	}
+	for name := range opts.skip {
+		if _, ok := v.Type().MethodByName(name); !ok {
+			return errors.Errorf("service %T has no method %s to skip", svc, name)
+		}
+	}
+	if v.NumMethod() == len(opts.skip) {
+		return errors.Errorf("service %T has no exported methods", svc)
+	}
+	funcs := make(map[string]*RPCFunc, v.NumMethod())
+	for i := 0; i < v.NumMethod(); i++ {
+		method := v.Type().Method(i)
+		if opts.skip[method.Name] {
+			continue
+		}
+		name := serviceMethodName(namespace, method.Name)
+		if _, ok := m[name]; ok {
+			return errors.Errorf("method %s of service %T is already registered as %q", method.Name, svc, name)
+		}
+		rpcFunc, err := newServiceFunc(v.Method(i))
+		if err != nil {
+			return errors.Wrapf(err, "method %s of service %T", method.Name, svc)
+		}
+		funcs[name] = rpcFunc
+	}
+	for name, rpcFunc := range funcs {
+		m[name] = rpcFunc
+	}
+	return nil
+}
+
+// serviceOptions configure FuncMap.RegisterService.
+type serviceOptions struct {
+	skip map[string]bool
+}
+
+// SkipMethods makes FuncMap.RegisterService skip the exported methods of the
+// service with the given Go names, e.g. SkipMethods("Close").
+func SkipMethods(names ...string) func(*serviceOptions) {
+	return func(opts *serviceOptions) {
+		for _, name := range names {
+			opts.skip[name] = true
+		}
+	}
+}
+
+// serviceMethodName returns the RPC method name of the Go method name in
+// namespace, lowering its first letter.
+func serviceMethodName(namespace, name string) string {
+	r, n := utf8.DecodeRuneInString(name)
+	name = string(unicode.ToLower(r)) + name[n:]
+	if namespace == "" {
+		return name
+	}
+	return namespace + "_" + name
+}
+
+// newServiceFunc returns the RPCFunc of the bound method f of a service.
+func newServiceFunc(f reflect.Value) (*RPCFunc, error) {
+	t := f.Type()
+	offset := leadingParams(t)
+	ws := offset > 0 && t.In(offset-1) == wsRPCContextType
+	switch t.NumIn() - offset {
+	case 0:
+		return newRPCFuncWithParams(f.Interface(), nil, nil, ws)
+	case 1:
+		if structType(t.In(offset)) != nil {
+			return newStructRPCFunc(f, offset, ws)
+		}
+	}
+	return nil, errors.Errorf("%v must take a single params struct after the context", t)
+}
+
+// leadingParams returns the number of leading parameters of the function type
+// t which are not named: a context.Context and then a types.WSRPCContext.
+func leadingParams(t reflect.Type) int {
+	offset := 0
+	if offset < t.NumIn() && t.In(offset) == contextType {
+		offset++
+	}
+	if offset < t.NumIn() && t.In(offset) == wsRPCContextType {
+		offset++
+	}
+	return offset
+}
+
+// structType returns the struct type of t if t is a params struct, or nil. A
+// params struct is a struct or a pointer to a struct, with at least one
+// exported field, which does not implement json.Unmarshaler: values like a
+// time.Time are decoded as a whole.
+func structType(t reflect.Type) reflect.Type {
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t.Kind() != reflect.Struct || reflect.PtrTo(t).Implements(jsonUnmarshalerType) {
+		return nil
+	}
+	for i := 0; i < t.NumField(); i++ {
+		if t.Field(i).PkgPath == "" {
+			return t
+		}
+	}
+	return nil
+}
+
+// newStructRPCFunc returns the RPCFunc of f, which takes a params struct after
+// offset leading parameters. The fields of the struct become the named
+// parameters of the RPCFunc.
+func newStructRPCFunc(f reflect.Value, offset int, ws bool) (*RPCFunc, error) {
+	t := f.Type()
+	paramsType := t.In(offset)
+	st := structType(paramsType)
+	fields, argNames, params, err := structParams(st)
+	if err != nil {
+		return nil, err
+	}
+
+	in := make([]reflect.Type, offset, offset+len(fields))
+	for i := range in {
+		in[i] = t.In(i)
+	}
+	for _, field := range fields {
+		in = append(in, st.Field(field).Type)
+	}
+	out := make([]reflect.Type, t.NumOut())
+	for i := range out {
+		out[i] = t.Out(i)
+	}
+	flat := reflect.MakeFunc(reflect.FuncOf(in, out, false), func(args []reflect.Value) []reflect.Value {
+		p := reflect.New(st)
+		for i, field := range fields {
+			p.Elem().Field(field).Set(args[offset+i])
+		}
+		if paramsType.Kind() != reflect.Ptr {
+			p = p.Elem()
+		}
+		return f.Call(append(args[:offset:offset], p))
+	})
+	return newRPCFuncWithParams(flat.Interface(), argNames, params, ws)
+}
+
+// structParams returns the indexes, names and declarations of the fields of
+// the params struct t.
+func structParams(t reflect.Type) ([]int, []string, []paramSpec, error) {
+	var (
+		fields   []int
+		argNames []string
+		params   []paramSpec
+		seen     = make(map[string]bool)
+	)
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if field.PkgPath != "" { // unexported
+			continue
+		}
+		name := field.Name
+		if tag := field.Tag.Get("json"); tag == "-" {
+			continue
+		} else if tag = strings.Split(tag, ",")[0]; tag != "" {
+			name = tag
+		}
+		if seen[name] {
+			return nil, nil, nil, errors.Errorf("parameter %q of %v is repeated", name, t)
+		}
+		seen[name] = true
+
+		var spec paramSpec
+		switch tag := field.Tag.Get("rpc"); {
+		case tag == "":
+		case tag == "required":
+			spec.mode = paramRequired
+		case tag == "optional":
+			spec.mode = paramOptional
+		case strings.HasPrefix(tag, "default="):
+			spec = paramSpec{mode: paramOptional, def: strings.TrimPrefix(tag, "default=")}
+			if spec.def == "" {
+				return nil, nil, nil, errors.Errorf("default value of parameter %q of %v is empty", name, t)
+			}
+		default:
+			return nil, nil, nil, errors.Errorf("invalid rpc tag %q of parameter %q of %v", tag, name, t)
+		}
+		validators, err := parseValidators(field.Type, field.Tag.Get("validate"))
+		if err != nil {
+			return nil, nil, nil, errors.Wrapf(err, "parameter %q of %v", name, t)
+		}
+		spec.validators = validators
+
+		fields = append(fields, i)
+		argNames = append(argNames, name)
+		params = append(params, spec)
+	}
+	return fields, argNames, params, nil
+}
@@ -0,0 +1,123 @@
+package krpcs
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tendermint/go-amino"
+
+	types "github.com/kooksee/krpc/types"
+)
+
+type testService struct{}
+
+type echoParams struct {
+	Message string `json:"message" rpc:"required"`
+	Repeat  int    `json:"repeat" rpc:"default=1"`
+	Suffix  string `json:",omitempty" rpc:"optional"`
+	Ignored string `json:"-"`
+	hidden  string // nolint: unused, structcheck
+}
+
+func (testService) Echo(ctx context.Context, p *echoParams) (string, error) {
+	return strings.Repeat(p.Message, p.Repeat) + p.Suffix, nil
+}
+
+func (testService) Sum(p struct{ A, B int }) int { return p.A + p.B }
+
+func (testService) Ping() {}
+
+func (testService) Subscribe(wsCtx types.WSRPCContext, p echoParams) error { return nil }
+
+func TestRegisterService(t *testing.T) {
+	funcMap := FuncMap{}
+	require.NoError(t, funcMap.RegisterService("test", testService{}))
+	require.Len(t, funcMap, 4)
+	assert.Equal(t, []string{"message", "repeat", "Suffix"}, funcMap["test_echo"].argNames)
+	assert.Equal(t, []string{"A", "B"}, funcMap["test_sum"].argNames)
+	assert.Empty(t, funcMap["test_ping"].argNames)
+	assert.True(t, funcMap["test_subscribe"].ws)
+
+	mux := http.NewServeMux()
+	RegisterRPCFuncs(mux, funcMap, amino.NewCodec())
+	tests := []struct {
+		method     string
+		params     string
+		wantResult string
+	}{
+		{"test_echo", `{"message": "a"}`, `"a"`},
+		{"test_echo", `{"message": "a", "repeat": "3", "Suffix": "!"}`, `"aaa!"`},
+		{"test_echo", `["a", "2"]`, `"aa"`},
+		{"test_sum", `["1", "2"]`, `"3"`},
+		{"test_ping", `[]`, `null`},
+	}
+	for _, tt := range tests {
+		body := strings.NewReader(`{"jsonrpc": "2.0", "method": "` + tt.method + `", "id": 1, "params": ` + tt.params + `}`)
+		req, _ := http.NewRequest("POST", "http://localhost/", body)
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, req)
+		var recv types.RPCResponse
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &recv), tt.params)
+		assert.Nil(t, recv.Error, tt.params)
+		assert.Equal(t, tt.wantResult, string(recv.Result), tt.params)
+	}
+
+	req, _ := http.NewRequest("GET", "http://localhost/test_echo?repeat=2", nil)
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, req)
+	var recv types.RPCResponse
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &recv))
+	require.NotNil(t, recv.Error)
+	assert.Equal(t, types.CodeInvalidParams, recv.Error.Code)
+}
+
+type badService struct{}
+
+func (badService) Echo(s string) string { return s }
+
+type badTagService struct{}
+
+func (badTagService) Echo(p struct {
+	S string `rpc:"sometimes"`
+}) {
+}
+
+type mixedService struct{ testService }
+
+func (mixedService) Close() error { return nil }
+
+func (mixedService) Lookup(key string) string { return key }
+
+func TestRegisterServiceSkipMethods(t *testing.T) {
+	funcMap := FuncMap{}
+	assert.Error(t, funcMap.RegisterService("", mixedService{}))
+	assert.Error(t, funcMap.RegisterService("", mixedService{}, SkipMethods("Lookup", "Nope")))
+	assert.Error(t, funcMap.RegisterService("", badService{}, SkipMethods("Echo")), "no methods are left")
+	assert.Empty(t, funcMap)
+
+	require.NoError(t, funcMap.RegisterService("", mixedService{}, SkipMethods("Lookup"), SkipMethods("Close", "Ping")))
+	assert.Len(t, funcMap, 3)
+	assert.Contains(t, funcMap, "echo")
+	assert.NotContains(t, funcMap, "lookup")
+	assert.NotContains(t, funcMap, "close")
+	assert.NotContains(t, funcMap, "ping")
+}
+
+func TestRegisterServiceErrors(t *testing.T) {
+	funcMap := FuncMap{}
+	assert.Error(t, funcMap.RegisterService("", nil))
+	assert.Error(t, funcMap.RegisterService("", struct{}{}))
+	assert.Error(t, funcMap.RegisterService("", badService{}))
+	assert.Error(t, funcMap.RegisterService("", badTagService{}))
+	assert.Empty(t, funcMap)
+
+	require.NoError(t, funcMap.RegisterService("", testService{}))
+	assert.Contains(t, funcMap, "echo")
+	assert.Error(t, funcMap.RegisterService("", testService{}), "methods are registered once")
+}
@@ -0,0 +1,258 @@
+package krpcs
+
+import (
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/pkg/errors"
+)
+
+// validator checks the value of a parameter, returning an error describing
+// why it is invalid.
+type validator func(v reflect.Value) error
+
+// namedRegexps are the regular expressions which can be named in the regexp
+// rule of the validate tag.
+var namedRegexps = map[string]*regexp.Regexp{
+	"int":     RE_INT,
+	"hex":     RE_HEX,
+	"email":   RE_EMAIL,
+	"address": RE_ADDRESS,
+	"host":    RE_HOST,
+	"id12":    RE_ID12,
+}
+
+// parseValidators returns the validators of a parameter of type t declared by
+// the validate tag of its field. The tag is a comma separated list of rules:
+//
+//	required     the value must not be the zero value (or empty)
+//	min=N        numbers must be at least N; strings, slices and maps must
+//	             have at least N characters or elements
+//	max=N        like min, but at most N
+//	regexp=NAME  non-empty strings must match the named regular expression
+//	             (int, hex, email, address, host or id12), or else NAME as a
+//	             pattern
+//
+// The regexp rule extends to the end of the tag, so that patterns may contain
+// commas (e.g. `validate:"required,regexp=^[a-z]{1,3}$"`); it must be the last
+// rule. The tag is invalid if a named regexp is followed by a comma, or the
+// text after a comma of a pattern is a rule, like in "regexp=hex,required".
+// Other rules than required are skipped for nil pointers.
+func parseValidators(t reflect.Type, tag string) ([]validator, error) {
+	if tag == "" {
+		return nil, nil
+	}
+	elem := t
+	if elem.Kind() == reflect.Ptr {
+		elem = elem.Elem()
+	}
+	var validators []validator
+	for rest, last := tag, false; !last; {
+		rule := strings.TrimSpace(rest)
+		switch i := strings.Index(rest, ","); {
+		case strings.HasPrefix(rule, "regexp="), i < 0:
+			last = true
+		default:
+			rule, rest = strings.TrimSpace(rest[:i]), rest[i+1:]
+		}
+		name, arg := rule, ""
+		if i := strings.Index(rule, "="); i >= 0 {
+			name, arg = rule[:i], rule[i+1:]
+		}
+		var (
+			v   validator
+			err error
+		)
+		switch name {
+		case "required":
+			v = validateRequired
+		case "min":
+			v, err = boundValidator(elem, arg, true)
+		case "max":
+			v, err = boundValidator(elem, arg, false)
+		case "regexp":
+			if err = checkLastRule(arg); err == nil {
+				v, err = regexpValidator(elem, arg)
+			}
+		default:
+			err = errors.Errorf("unknown rule %q", rule)
+		}
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid validate tag %q", tag)
+		}
+		if name != "required" {
+			v = skipNil(v)
+		}
+		validators = append(validators, v)
+	}
+	return validators, nil
+}
+
+func validateRequired(v reflect.Value) error {
+	switch v.Kind() {
+	case reflect.Ptr, reflect.Interface:
+		if v.IsNil() {
+			return errMissingParam
+		}
+	case reflect.String, reflect.Slice, reflect.Map:
+		if v.Len() == 0 {
+			return errMissingParam
+		}
+	default:
+		if reflect.DeepEqual(v.Interface(), reflect.Zero(v.Type()).Interface()) {
+			return errMissingParam
+		}
+	}
+	return nil
+}
+
+// skipNil returns a validator which dereferences pointers for v, and accepts
+// nil pointers.
+func skipNil(v validator) validator {
+	return func(value reflect.Value) error {
+		if value.Kind() == reflect.Ptr {
+			if value.IsNil() {
+				return nil
+			}
+			value = value.Elem()
+		}
+		return v(value)
+	}
+}
+
+// boundValidator returns a validator checking the lower (if min) or upper
+// bound arg of values of type t.
+func boundValidator(t reflect.Type, arg string, min bool) (validator, error) {
+	word, op := "at most", "max"
+	if min {
+		word, op = "at least", "min"
+	}
+	check := func(cmp int) error {
+		if (min && cmp < 0) || (!min && cmp > 0) {
+			return errors.Errorf("must be %s %s", word, arg)
+		}
+		return nil
+	}
+	switch t.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		bound, err := strconv.ParseInt(arg, 10, 64)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid %s", op)
+		}
+		return func(v reflect.Value) error { return check(compareInt(v.Int(), bound)) }, nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		bound, err := strconv.ParseUint(arg, 10, 64)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid %s", op)
+		}
+		return func(v reflect.Value) error {
+			switch x := v.Uint(); {
+			case x < bound:
+				return check(-1)
+			case x > bound:
+				return check(1)
+			}
+			return nil
+		}, nil
+	case reflect.Float32, reflect.Float64:
+		bound, err := strconv.ParseFloat(arg, 64)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid %s", op)
+		}
+		return func(v reflect.Value) error {
+			switch x := v.Float(); {
+			case x < bound:
+				return check(-1)
+			case x > bound:
+				return check(1)
+			}
+			return nil
+		}, nil
+	case reflect.String, reflect.Slice, reflect.Map, reflect.Array:
+		bound, err := strconv.ParseInt(arg, 10, 64)
+		if err != nil || bound < 0 {
+			return nil, errors.Errorf("invalid %s length %q", op, arg)
+		}
+		word = "of length " + word
+		return func(v reflect.Value) error {
+			n := v.Len()
+			if v.Kind() == reflect.String {
+				n = utf8.RuneCountInString(v.String())
+			}
+			return check(compareInt(int64(n), bound))
+		}, nil
+	}
+	return nil, errors.Errorf("%s does not apply to %v", op, t)
+}
+
+func compareInt(x, y int64) int {
+	switch {
+	case x < y:
+		return -1
+	case x > y:
+		return 1
+	}
+	return 0
+}
+
+// regexpValidator returns a validator checking that strings of type t match
+// the regular expression named arg, or else the pattern arg.
+// checkLastRule returns an error if the argument of a regexp rule, which
+// extends to the end of the tag, looks like it is followed by other rules.
+func checkLastRule(arg string) error {
+	parts := strings.Split(arg, ",")
+	if len(parts) == 1 {
+		return nil
+	}
+	if _, ok := namedRegexps[strings.TrimSpace(parts[0])]; ok {
+		return errors.New("the regexp rule must be the last rule")
+	}
+	for _, part := range parts[1:] {
+		part = strings.TrimSpace(part)
+		if part == "required" || strings.HasPrefix(part, "min=") ||
+			strings.HasPrefix(part, "max=") || strings.HasPrefix(part, "regexp=") {
+			return errors.Errorf("the regexp rule must be the last rule, found %q after it", part)
+		}
+	}
+	return nil
+}
+
+func regexpValidator(t reflect.Type, arg string) (validator, error) {
+	if t.Kind() != reflect.String {
+		return nil, errors.Errorf("regexp does not apply to %v", t)
+	}
+	re, ok := namedRegexps[arg]
+	if !ok {
+		var err error
+		if re, err = regexp.Compile(arg); err != nil || arg == "" {
+			return nil, errors.Errorf("invalid regexp %q", arg)
+		}
+	}
+	return func(v reflect.Value) error {
+		if s := v.String(); s != "" && !re.MatchString(s) {
+			return errors.Errorf("must match %s", arg)
+		}
+		return nil
+	}, nil
+}
+
+// validateArgs runs the validators of the named arguments of f on values,
+// returning an error listing each invalid parameter.
+func (f *RPCFunc) validateArgs(values []reflect.Value) error {
+	invalid := &invalidFieldsError{}
+	for i, spec := range f.params {
+		for _, validate := range spec.validators {
+			if err := validate(values[i]); err != nil {
+				invalid.add(f.argNames[i], err)
+				break
+			}
+		}
+	}
+	if len(invalid.fields) > 0 {
+		return invalid
+	}
+	return nil
+}
@@ -0,0 +1,165 @@
+package krpcs
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tendermint/go-amino"
+
+	types "github.com/kooksee/krpc/types"
+)
+
+func TestParseValidators(t *testing.T) {
+	var (
+		intType    = reflect.TypeOf(0)
+		uintType   = reflect.TypeOf(uint(0))
+		floatType  = reflect.TypeOf(0.0)
+		stringType = reflect.TypeOf("")
+		sliceType  = reflect.TypeOf([]int{})
+		ptrType    = reflect.TypeOf((*int)(nil))
+	)
+	one := 1
+	tests := []struct {
+		t       reflect.Type
+		tag     string
+		value   interface{}
+		wantErr string
+	}{
+		{intType, "", 0, ""},
+		{intType, "required", 1, ""},
+		{intType, "required", 0, "is required"},
+		{stringType, "required", "", "is required"},
+		{sliceType, "required", []int{}, "is required"},
+		{ptrType, "required", (*int)(nil), "is required"},
+		{ptrType, "required,min=2", &one, "must be at least 2"},
+		{ptrType, "min=2", (*int)(nil), ""},
+		{intType, "min=1,max=100", 100, ""},
+		{intType, "min=1,max=100", 0, "must be at least 1"},
+		{intType, "min=1,max=100", 101, "must be at most 100"},
+		{uintType, "max=3", uint(4), "must be at most 3"},
+		{floatType, "min=0.5", 0.25, "must be at least 0.5"},
+		{stringType, "min=2", "é", "must be of length at least 2"},
+		{stringType, "max=2", "éé", ""},
+		{sliceType, "max=1", []int{1, 2}, "must be of length at most 1"},
+		{stringType, "regexp=hex", "0aF", ""},
+		{stringType, "regexp=hex", "0x", "must match hex"},
+		{stringType, "regexp=^a+$", "aa", ""},
+		{stringType, "regexp=^a+$", "ab", "must match ^a+$"},
+		{stringType, "required,regexp=^[a-z]{1,3}$", "abc", ""},
+		{stringType, "required,regexp=^[a-z]{1,3}$", "abcd", "must match ^[a-z]{1,3}$"},
+		{stringType, " min=1 , regexp=^(a|b),c$", "b,c", ""},
+	}
+	for i, tt := range tests {
+		validators, err := parseValidators(tt.t, tt.tag)
+		require.NoError(t, err, "#%d", i)
+		var errs []string
+		for _, v := range validators {
+			if err := v(reflect.ValueOf(tt.value)); err != nil {
+				errs = append(errs, err.Error())
+			}
+		}
+		if tt.wantErr == "" {
+			assert.Empty(t, errs, "#%d", i)
+		} else {
+			assert.Contains(t, errs, tt.wantErr, "#%d", i)
+		}
+	}
+
+	for i, tt := range []struct {
+		t   reflect.Type
+		tag string
+	}{
+		{intType, "sometimes"},
+		{intType, "min=x"},
+		{uintType, "max=-1"},
+		{stringType, "min=-1"},
+		{reflect.TypeOf(true), "max=1"},
+		{intType, "regexp=hex"},
+		{stringType, "regexp=("},
+		{stringType, "regexp="},
+		{stringType, "min=1,"},
+		{stringType, "regexp=(,required"},
+		{stringType, "regexp=hex,required"},
+		{stringType, "regexp=hex,"},
+		{stringType, "regexp=^a+$, min=1"},
+		{stringType, "regexp=^a+$,max=2"},
+		{stringType, "regexp=^a+$,regexp=hex"},
+	} {
+		_, err := parseValidators(tt.t, tt.tag)
+		assert.Error(t, err, "#%d", i)
+	}
+}
+
+type searchParams struct {
+	Query string `json:"q" validate:"required,max=10"`
+	Limit int    `json:"limit" validate:"min=1,max=100" rpc:"default=10"`
+	ID    string `json:"id" validate:"regexp=id12" rpc:"optional"`
+}
+
+func TestRPCValidation(t *testing.T) {
+	funcMap := map[string]*RPCFunc{
+		"search": NewRPCFunc(func(p searchParams) int { return p.Limit }, ""),
+	}
+	mux := http.NewServeMux()
+	RegisterRPCFuncs(mux, funcMap, amino.NewCodec())
+
+	tests := []struct {
+		params     string
+		wantFields []types.FieldError
+	}{
+		{`{"q": "a"}`, nil},
+		{`["a", "100", "abcdefABCDEF"]`, nil},
+		{`{"limit": "0", "id": "x"}`, []types.FieldError{
+			{Field: "q", Message: "is required"},
+			{Field: "limit", Message: "must be at least 1"},
+			{Field: "id", Message: "must match id12"},
+		}},
+		{`["abcdefghijk", "101"]`, []types.FieldError{
+			{Field: "q", Message: "must be of length at most 10"},
+			{Field: "limit", Message: "must be at most 100"},
+		}},
+		// no params
+		{``, []types.FieldError{{Field: "q", Message: "is required"}}},
+	}
+	for _, tt := range tests {
+		payload := `{"jsonrpc": "2.0", "method": "search", "id": 1`
+		if tt.params != "" {
+			payload += `, "params": ` + tt.params
+		}
+		body := strings.NewReader(payload + "}")
+		req, _ := http.NewRequest("POST", "http://localhost/", body)
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, req)
+		var recv types.RPCResponse
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &recv), tt.params)
+		if tt.wantFields == nil {
+			assert.Nil(t, recv.Error, tt.params)
+			continue
+		}
+		require.NotNil(t, recv.Error, tt.params)
+		assert.Equal(t, types.CodeInvalidParams, recv.Error.Code, tt.params)
+		var fields []types.FieldError
+		require.NoError(t, recv.Error.DecodeData(&fields), tt.params)
+		assert.Equal(t, tt.wantFields, fields, tt.params)
+	}
+
+	req, _ := http.NewRequest("GET", "http://localhost/search?q=%22a%22&limit=1000", nil)
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, req)
+	var recv types.RPCResponse
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &recv))
+	require.NotNil(t, recv.Error)
+	assert.Equal(t, types.CodeInvalidParams, recv.Error.Code)
+
+	_, err := TryNewRPCFunc(func(p struct {
+		A bool `validate:"min=1"`
+	}) {
+	}, "")
+	assert.Error(t, err)
+}
@@ -27,5 +27,8 @@ func main() {
 	mux := http.NewServeMux()
 	cdc := amino.NewCodec()
 	krpcs.RegisterRPCFuncs(mux, routes, cdc)
-	krpcs.StartHTTPServer("tcp://0.0.0.0:8008", mux, krpcs.Config{})
+	if err := krpcs.NewServer("tcp://0.0.0.0:8008", mux, krpcs.DefaultConfig()).Start(); err != nil {
+		panic(err)
+	}
+	select {}
 }
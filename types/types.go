@@ -1,26 +1,107 @@
 package rpctypes
 
 import (
+	"bytes"
 	"encoding/json"
+	stderrors "errors"
 	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
 
 	"github.com/pkg/errors"
 
 	"github.com/tendermint/go-amino"
 )
 
+//----------------------------------------
+// ID
+
+// JSONRPCID is the id of a request, which the server echoes in the response.
+// It holds a string, a number or null exactly as received, or nothing at all
+// for notifications. JSONRPCIDs are comparable.
+type JSONRPCID struct {
+	raw string // JSON encoding of the id, empty if there is none
+}
+
+func StringID(id string) JSONRPCID {
+	raw, _ := json.Marshal(id) // nolint: errcheck
+	return JSONRPCID{raw: string(raw)}
+}
+
+func IntID(id int64) JSONRPCID {
+	return JSONRPCID{raw: strconv.FormatInt(id, 10)}
+}
+
+func NullID() JSONRPCID {
+	return JSONRPCID{raw: "null"}
+}
+
+// IsEmpty returns true if there is no id, i.e. the request is a notification.
+func (id JSONRPCID) IsEmpty() bool {
+	return id.raw == ""
+}
+
+// IsNull returns true if the id is null.
+func (id JSONRPCID) IsNull() bool {
+	return id.raw == "null"
+}
+
+// String returns a string id unquoted, and the JSON encoding otherwise.
+func (id JSONRPCID) String() string {
+	var s string
+	if err := json.Unmarshal([]byte(id.raw), &s); err == nil {
+		return s
+	}
+	return id.raw
+}
+
+// MarshalJSON implements json.Marshaler. An empty id is encoded as null.
+func (id JSONRPCID) MarshalJSON() ([]byte, error) {
+	if id.raw == "" {
+		return []byte("null"), nil
+	}
+	return []byte(id.raw), nil
+}
+
+// UnmarshalJSON implements json.Unmarshaler.
+func (id *JSONRPCID) UnmarshalJSON(data []byte) error {
+	data = bytes.TrimSpace(data)
+	if len(data) == 0 {
+		return errors.New("empty JSON-RPC id")
+	}
+	switch c := data[0]; {
+	case c == 'n' && string(data) == "null":
+	case c == '"':
+		var s string
+		if err := json.Unmarshal(data, &s); err != nil {
+			return err
+		}
+	case c == '-' || (c >= '0' && c <= '9'):
+		var n json.Number
+		if err := json.Unmarshal(data, &n); err != nil {
+			return err
+		}
+	default:
+		return errors.Errorf("JSON-RPC id must be a string, number or null, got %s", data)
+	}
+	id.raw = string(data)
+	return nil
+}
+
 //----------------------------------------
 // REQUEST
 
 type RPCRequest struct {
 	JSONRPC string          `json:"jsonrpc"`
-	ID      string          `json:"id"`
+	ID      JSONRPCID       `json:"id"`
 	Method  string          `json:"method"`
 	Params  json.RawMessage `json:"params"` // must be map[string]interface{} or []interface{}
 }
 
-func NewRPCRequest(id string, method string, params json.RawMessage) RPCRequest {
+func NewRPCRequest(id JSONRPCID, method string, params json.RawMessage) RPCRequest {
 	return RPCRequest{
 		JSONRPC: "2.0",
 		ID:      id,
@@ -29,11 +110,26 @@ func NewRPCRequest(id string, method string, params json.RawMessage) RPCRequest
 	}
 }
 
+// MarshalJSON implements json.Marshaler. The id member is left out of
+// notifications.
+func (req RPCRequest) MarshalJSON() ([]byte, error) {
+	var id *JSONRPCID
+	if !req.ID.IsEmpty() {
+		id = &req.ID
+	}
+	return json.Marshal(struct {
+		JSONRPC string          `json:"jsonrpc"`
+		ID      *JSONRPCID      `json:"id,omitempty"`
+		Method  string          `json:"method"`
+		Params  json.RawMessage `json:"params"`
+	}{req.JSONRPC, id, req.Method, req.Params})
+}
+
 func (req RPCRequest) String() string {
 	return fmt.Sprintf("[%s %s]", req.ID, req.Method)
 }
 
-func MapToRequest(cdc *amino.Codec, id string, method string, params map[string]interface{}) (RPCRequest, error) {
+func MapToRequest(cdc *amino.Codec, id JSONRPCID, method string, params map[string]interface{}) (RPCRequest, error) {
 	var params_ = make(map[string]json.RawMessage, len(params))
 	for name, value := range params {
 		valueJSON, err := cdc.MarshalJSON(value)
@@ -50,7 +146,7 @@ func MapToRequest(cdc *amino.Codec, id string, method string, params map[string]
 	return request, nil
 }
 
-func ArrayToRequest(cdc *amino.Codec, id string, method string, params []interface{}) (RPCRequest, error) {
+func ArrayToRequest(cdc *amino.Codec, id JSONRPCID, method string, params []interface{}) (RPCRequest, error) {
 	var params_ = make([]json.RawMessage, len(params))
 	for i, value := range params {
 		valueJSON, err := cdc.MarshalJSON(value)
@@ -73,28 +169,220 @@ func ArrayToRequest(cdc *amino.Codec, id string, method string, params []interfa
 type RPCError struct {
 	Code    int    `json:"code"`
 	Message string `json:"message"`
-	Data    string `json:"data,omitempty"`
+	// Data is the JSON encoding of additional information about the error.
+	Data json.RawMessage `json:"data,omitempty"`
+
+	// data is encoded into Data by the server, see NewRPCError.
+	data interface{}
+}
+
+// CodedError is implemented by errors which carry their own JSON-RPC error
+// code and data. An RPC function returning a CodedError has it sent with its
+// code and data instead of as an internal error.
+type CodedError interface {
+	error
+	RPCCode() int
+	RPCData() interface{}
+}
+
+// NewRPCError returns an error which RPC functions can return to have it sent
+// as is. data may be nil; otherwise it is encoded with the codec of the server.
+func NewRPCError(code int, msg string, data interface{}) *RPCError {
+	return &RPCError{Code: code, Message: msg, data: data}
+}
+
+// RPCCode implements CodedError.
+func (err *RPCError) RPCCode() int {
+	return err.Code
+}
+
+// RPCData implements CodedError. It returns the data passed to NewRPCError,
+// or else Data.
+func (err *RPCError) RPCData() interface{} {
+	if err.data != nil {
+		return err.data
+	}
+	if len(err.Data) == 0 {
+		return nil
+	}
+	return err.Data
+}
+
+// DecodeData unmarshals Data into v.
+func (err *RPCError) DecodeData(v interface{}) error {
+	if len(err.Data) == 0 {
+		return errors.New("no error data")
+	}
+	return json.Unmarshal(err.Data, v)
+}
+
+// EncodeErrorData returns the JSON encoding of error data with cdc. Strings
+// and json.RawMessage are encoded with encoding/json, so that they are not
+// affected by amino.
+func EncodeErrorData(cdc *amino.Codec, data interface{}) (json.RawMessage, error) {
+	switch d := data.(type) {
+	case nil:
+		return nil, nil
+	case json.RawMessage:
+		return d, nil
+	case string:
+		return json.Marshal(d)
+	}
+	return cdc.MarshalJSON(data)
+}
+
+// FieldError describes an invalid field of the params. A list of FieldErrors
+// is the data of invalid params errors caused by validation.
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// Unwrap returns the error registered for the code of err with RegisterError,
+// so that errors.Is matches it.
+func (err *RPCError) Unwrap() error {
+	return RegisteredError(err.Code)
 }
 
-func (err RPCError) Error() string {
+// Error codes defined by the JSON-RPC 2.0 specification. Codes from -32768
+// to -32000 are reserved.
+const (
+	CodeParseError     = -32700
+	CodeInvalidRequest = -32600
+	CodeMethodNotFound = -32601
+	CodeInvalidParams  = -32602
+	CodeInternalError  = -32603
+	CodeServerError    = -32000
+)
+
+var (
+	errorRegistryMtx sync.RWMutex
+	errorsByCode     = make(map[int]error)
+	codesByError     = make(map[error]int)
+)
+
+// RegisterError registers err as the application error with the given code.
+// RPC functions returning err are answered with code, and errors with code
+// received by the clients match err with errors.Is. err must be comparable,
+// like the errors created by errors.New. It panics if code is reserved by the
+// JSON-RPC specification or err or code is registered already.
+func RegisterError(code int, err error) {
+	if code >= -32768 && code <= -32000 {
+		panic(fmt.Sprintf("RegisterError: code %d is reserved", code))
+	}
+	if err == nil || !reflect.TypeOf(err).Comparable() {
+		panic(fmt.Sprintf("RegisterError: error %v is not comparable", err))
+	}
+	errorRegistryMtx.Lock()
+	defer errorRegistryMtx.Unlock()
+	if _, ok := errorsByCode[code]; ok {
+		panic(fmt.Sprintf("RegisterError: code %d is registered already", code))
+	}
+	if _, ok := codesByError[err]; ok {
+		panic(fmt.Sprintf("RegisterError: error %q is registered already", err))
+	}
+	errorsByCode[code] = err
+	codesByError[err] = code
+}
+
+// RegisteredError returns the error registered for code, or nil.
+func RegisteredError(code int) error {
+	errorRegistryMtx.RLock()
+	defer errorRegistryMtx.RUnlock()
+	return errorsByCode[code]
+}
+
+// RegisteredCodes returns the codes registered with RegisterError, in
+// ascending order.
+func RegisteredCodes() []int {
+	errorRegistryMtx.RLock()
+	defer errorRegistryMtx.RUnlock()
+	codes := make([]int, 0, len(errorsByCode))
+	for code := range errorsByCode {
+		codes = append(codes, code)
+	}
+	sort.Ints(codes)
+	return codes
+}
+
+// RegisteredCode returns the code registered for err.
+func RegisteredCode(err error) (int, bool) {
+	if err == nil || !reflect.TypeOf(err).Comparable() {
+		return 0, false
+	}
+	errorRegistryMtx.RLock()
+	defer errorRegistryMtx.RUnlock()
+	code, ok := codesByError[err]
+	return code, ok
+}
+
+// AsRPCError returns the *RPCError in the chain of err, as returned by the
+// clients for error responses.
+func AsRPCError(err error) (*RPCError, bool) {
+	var rpcErr *RPCError
+	if stderrors.As(err, &rpcErr) {
+		return rpcErr, true
+	}
+	return nil, false
+}
+
+func hasCode(err error, code int) bool {
+	rpcErr, ok := AsRPCError(err)
+	return ok && rpcErr.Code == code
+}
+
+// IsParseError reports whether err is a parse error response.
+func IsParseError(err error) bool { return hasCode(err, CodeParseError) }
+
+// IsInvalidRequest reports whether err is an invalid request error response.
+func IsInvalidRequest(err error) bool { return hasCode(err, CodeInvalidRequest) }
+
+// IsMethodNotFound reports whether err is a method not found error response.
+func IsMethodNotFound(err error) bool { return hasCode(err, CodeMethodNotFound) }
+
+// IsInvalidParams reports whether err is an invalid params error response.
+func IsInvalidParams(err error) bool { return hasCode(err, CodeInvalidParams) }
+
+// IsInternalError reports whether err is an internal error response.
+func IsInternalError(err error) bool { return hasCode(err, CodeInternalError) }
+
+func (err *RPCError) Error() string {
 	const baseFormat = "RPC error %v - %s"
-	if err.Data != "" {
-		return fmt.Sprintf(baseFormat+": %s", err.Code, err.Message, err.Data)
+	if len(err.Data) > 0 {
+		// show string data without the quotes
+		var data string
+		if json.Unmarshal(err.Data, &data) != nil {
+			data = string(err.Data)
+		}
+		return fmt.Sprintf(baseFormat+": %s", err.Code, err.Message, data)
 	}
 	return fmt.Sprintf(baseFormat, err.Code, err.Message)
 }
 
 type RPCResponse struct {
 	JSONRPC string          `json:"jsonrpc"`
-	ID      string          `json:"id"`
+	ID      JSONRPCID       `json:"id"`
 	Result  json.RawMessage `json:"result,omitempty"`
 	Error   *RPCError       `json:"error,omitempty"`
 }
 
-func NewRPCSuccessResponse(cdc *amino.Codec, id string, res interface{}) RPCResponse {
-	var rawMsg json.RawMessage
+// NewRPCSuccessResponse returns a response with the JSON (amino) encoding of
+// res as result. A nil res is sent as a null result, and a json.RawMessage
+// (or pointer to one) is sent as is.
+func NewRPCSuccessResponse(cdc *amino.Codec, id JSONRPCID, res interface{}) RPCResponse {
+	rawMsg := json.RawMessage("null")
 
-	if res != nil {
+	switch raw := res.(type) {
+	case json.RawMessage:
+		if raw != nil {
+			rawMsg = raw
+		}
+	case *json.RawMessage:
+		if raw != nil && *raw != nil {
+			rawMsg = *raw
+		}
+	case nil:
+	default:
 		var js []byte
 		js, err := cdc.MarshalJSON(res)
 		if err != nil {
@@ -106,7 +394,19 @@ func NewRPCSuccessResponse(cdc *amino.Codec, id string, res interface{}) RPCResp
 	return RPCResponse{JSONRPC: "2.0", ID: id, Result: rawMsg}
 }
 
-func NewRPCErrorResponse(id string, code int, msg string, data string) RPCResponse {
+// NewRPCErrorResponse returns an error response. data is sent as a JSON
+// string, unless it is empty.
+func NewRPCErrorResponse(id JSONRPCID, code int, msg string, data string) RPCResponse {
+	var raw json.RawMessage
+	if data != "" {
+		raw, _ = json.Marshal(data) // nolint: errcheck
+	}
+	return NewRPCErrorResponseWithData(id, code, msg, raw)
+}
+
+// NewRPCErrorResponseWithData returns an error response with the JSON encoded
+// data.
+func NewRPCErrorResponseWithData(id JSONRPCID, code int, msg string, data json.RawMessage) RPCResponse {
 	return RPCResponse{
 		JSONRPC: "2.0",
 		ID:      id,
@@ -121,28 +421,68 @@ func (resp RPCResponse) String() string {
 	return fmt.Sprintf("[%s %s]", resp.ID, resp.Error)
 }
 
-func RPCParseError(id string, err error) RPCResponse {
-	return NewRPCErrorResponse(id, -32700, "Parse error. Invalid JSON", err.Error())
+func RPCParseError(id JSONRPCID, err error) RPCResponse {
+	return NewRPCErrorResponse(id, CodeParseError, "Parse error. Invalid JSON", err.Error())
+}
+
+func RPCInvalidRequestError(id JSONRPCID, err error) RPCResponse {
+	return NewRPCErrorResponse(id, CodeInvalidRequest, "Invalid Request", err.Error())
 }
 
-func RPCInvalidRequestError(id string, err error) RPCResponse {
-	return NewRPCErrorResponse(id, -32600, "Invalid Request", err.Error())
+func RPCMethodNotFoundError(id JSONRPCID) RPCResponse {
+	return NewRPCErrorResponse(id, CodeMethodNotFound, "Method not found", "")
 }
 
-func RPCMethodNotFoundError(id string) RPCResponse {
-	return NewRPCErrorResponse(id, -32601, "Method not found", "")
+func RPCInvalidParamsError(id JSONRPCID, err error) RPCResponse {
+	return NewRPCErrorResponse(id, CodeInvalidParams, "Invalid params", err.Error())
 }
 
-func RPCInvalidParamsError(id string, err error) RPCResponse {
-	return NewRPCErrorResponse(id, -32602, "Invalid params", err.Error())
+// RPCInvalidFieldsError returns an invalid params error with the invalid
+// fields as data.
+func RPCInvalidFieldsError(id JSONRPCID, fields []FieldError) RPCResponse {
+	data, err := json.Marshal(fields)
+	if err != nil {
+		return RPCInternalError(id, errors.Wrap(err, "Error marshalling invalid fields"))
+	}
+	return NewRPCErrorResponseWithData(id, CodeInvalidParams, "Invalid params", data)
 }
 
-func RPCInternalError(id string, err error) RPCResponse {
-	return NewRPCErrorResponse(id, -32603, "Internal error", err.Error())
+func RPCInternalError(id JSONRPCID, err error) RPCResponse {
+	return NewRPCErrorResponse(id, CodeInternalError, "Internal error", err.Error())
 }
 
-func RPCServerError(id string, err error) RPCResponse {
-	return NewRPCErrorResponse(id, -32000, "Server error", err.Error())
+func RPCServerError(id JSONRPCID, err error) RPCResponse {
+	return NewRPCErrorResponse(id, CodeServerError, "Server error", err.Error())
+}
+
+//----------------------------------------
+// EVENTS
+
+// ResultSubscribe is the result of the built-in subscribe method.
+type ResultSubscribe struct{}
+
+// ResultUnsubscribe is the result of the built-in unsubscribe and
+// unsubscribe_all methods.
+type ResultUnsubscribe struct{}
+
+// ResultEvent is pushed to websocket subscribers for every event published
+// under their query. Data is the JSON (amino) encoding of the event data.
+type ResultEvent struct {
+	Query string          `json:"query"`
+	Data  json.RawMessage `json:"data"`
+}
+
+func NewRPCEventResponse(cdc *amino.Codec, id JSONRPCID, query string, data interface{}) RPCResponse {
+	dataJSON, err := cdc.MarshalJSON(data)
+	if err != nil {
+		return RPCInternalError(id, errors.Wrap(err, "Error marshalling event data"))
+	}
+	// NOTE: amino would encode the raw data as bytes.
+	result, err := json.Marshal(ResultEvent{Query: query, Data: dataJSON})
+	if err != nil {
+		return RPCInternalError(id, errors.Wrap(err, "Error marshalling event"))
+	}
+	return RPCResponse{JSONRPC: "2.0", ID: id, Result: result}
 }
 
 //----------------------------------------
@@ -2,6 +2,7 @@ package rpctypes
 
 import (
 	"encoding/json"
+	stderrors "errors"
 	"testing"
 
 	"fmt"
@@ -19,20 +20,31 @@ func TestResponses(t *testing.T) {
 	assert := assert.New(t)
 	cdc := amino.NewCodec()
 
-	a := NewRPCSuccessResponse(cdc, "1", &SampleResult{"hello"})
+	a := NewRPCSuccessResponse(cdc, StringID("1"), &SampleResult{"hello"})
 	b, _ := json.Marshal(a)
 	s := `{"jsonrpc":"2.0","id":"1","result":{"Value":"hello"}}`
 	assert.Equal(string(s), string(b))
 
-	d := RPCParseError("1", errors.New("Hello world"))
+	d := RPCParseError(StringID("1"), errors.New("Hello world"))
 	e, _ := json.Marshal(d)
 	f := `{"jsonrpc":"2.0","id":"1","error":{"code":-32700,"message":"Parse error. Invalid JSON","data":"Hello world"}}`
 	assert.Equal(string(f), string(e))
 
-	g := RPCMethodNotFoundError("2")
+	g := RPCMethodNotFoundError(StringID("2"))
 	h, _ := json.Marshal(g)
 	i := `{"jsonrpc":"2.0","id":"2","error":{"code":-32601,"message":"Method not found"}}`
 	assert.Equal(string(h), string(i))
+
+	raw := json.RawMessage(`{"value": [1]}`)
+	for _, res := range []interface{}{raw, &raw} {
+		j, _ := json.Marshal(NewRPCSuccessResponse(cdc, StringID("3"), res))
+		assert.Equal(`{"jsonrpc":"2.0","id":"3","result":{"value":[1]}}`, string(j))
+	}
+	// other byte slices are still amino encoded, as base64
+	k, _ := json.Marshal(NewRPCSuccessResponse(cdc, StringID("4"), []byte{1, 2}))
+	assert.Equal(`{"jsonrpc":"2.0","id":"4","result":"AQI="}`, string(k))
+	l, _ := json.Marshal(NewRPCSuccessResponse(cdc, StringID("5"), json.RawMessage(nil)))
+	assert.Equal(`{"jsonrpc":"2.0","id":"5","result":null}`, string(l))
 }
 
 func TestRPCError(t *testing.T) {
@@ -40,7 +52,7 @@ func TestRPCError(t *testing.T) {
 		fmt.Sprintf("%v", &RPCError{
 			Code:    12,
 			Message: "Badness",
-			Data:    "One worse than a code 11",
+			Data:    json.RawMessage(`"One worse than a code 11"`),
 		}))
 
 	assert.Equal(t, "RPC error 12 - Badness",
@@ -49,3 +61,121 @@ func TestRPCError(t *testing.T) {
 			Message: "Badness",
 		}))
 }
+
+func TestJSONRPCID(t *testing.T) {
+	cases := []struct {
+		raw   string
+		id    JSONRPCID
+		isErr bool
+	}{
+		{`"1"`, StringID("1"), false},
+		{`1`, IntID(1), false},
+		{`-42`, IntID(-42), false},
+		{`null`, NullID(), false},
+		{`{}`, JSONRPCID{}, true},
+		{`[1]`, JSONRPCID{}, true},
+		{`true`, JSONRPCID{}, true},
+	}
+	for i, tc := range cases {
+		var id JSONRPCID
+		err := json.Unmarshal([]byte(tc.raw), &id)
+		if tc.isErr {
+			assert.Error(t, err, "#%d", i)
+			continue
+		}
+		if assert.NoError(t, err, "#%d", i) {
+			assert.Equal(t, tc.id, id, "#%d", i)
+			b, err := json.Marshal(id)
+			assert.NoError(t, err, "#%d", i)
+			assert.Equal(t, tc.raw, string(b), "#%d: ids round-trip as received", i)
+		}
+	}
+	assert.Equal(t, "1", StringID("1").String())
+	assert.Equal(t, "2", IntID(2).String())
+}
+
+func TestRequestID(t *testing.T) {
+	// the id member is left out of notifications
+	b, err := json.Marshal(NewRPCRequest(JSONRPCID{}, "m", nil))
+	assert.NoError(t, err)
+	assert.Equal(t, `{"jsonrpc":"2.0","method":"m","params":null}`, string(b))
+
+	b, err = json.Marshal(NewRPCRequest(IntID(5), "m", nil))
+	assert.NoError(t, err)
+	assert.Equal(t, `{"jsonrpc":"2.0","id":5,"method":"m","params":null}`, string(b))
+
+	var req RPCRequest
+	assert.NoError(t, json.Unmarshal([]byte(`{"jsonrpc":"2.0","method":"m"}`), &req))
+	assert.True(t, req.ID.IsEmpty())
+	assert.NoError(t, json.Unmarshal([]byte(`{"jsonrpc":"2.0","id":null,"method":"m"}`), &req))
+	assert.True(t, req.ID.IsNull())
+}
+
+// unregisterError removes the error registered for code, so that tests
+// registering errors can run more than once.
+func unregisterError(code int) {
+	errorRegistryMtx.Lock()
+	defer errorRegistryMtx.Unlock()
+	delete(codesByError, errorsByCode[code])
+	delete(errorsByCode, code)
+}
+
+func TestRegisterError(t *testing.T) {
+	errNotFound := errors.New("not found")
+	RegisterError(1404, errNotFound)
+	defer unregisterError(1404)
+
+	assert.Panics(t, func() { RegisterError(CodeInvalidParams, errors.New("reserved")) })
+	assert.Panics(t, func() { RegisterError(1404, errors.New("duplicate code")) })
+	assert.Panics(t, func() { RegisterError(1405, errNotFound) })
+
+	assert.Contains(t, RegisteredCodes(), 1404)
+
+	code, ok := RegisteredCode(errNotFound)
+	assert.True(t, ok)
+	assert.Equal(t, 1404, code)
+	_, ok = RegisteredCode(errors.New("not found"))
+	assert.False(t, ok, "errors are matched by identity")
+
+	var err error = &RPCError{Code: 1404, Message: "not found"}
+	assert.True(t, stderrors.Is(err, errNotFound))
+	assert.False(t, stderrors.Is(&RPCError{Code: 1500}, errNotFound))
+}
+
+func TestRPCErrorHelpers(t *testing.T) {
+	var err error = RPCMethodNotFoundError(StringID("1")).Error
+	assert.True(t, IsMethodNotFound(err))
+	assert.False(t, IsInvalidParams(err))
+	assert.True(t, IsInvalidParams(RPCInvalidParamsError(StringID("1"), errors.New("bad")).Error))
+	assert.True(t, IsInternalError(fmt.Errorf("wrapped: %w", RPCInternalError(StringID("1"), errors.New("boom")).Error)))
+	assert.False(t, IsMethodNotFound(errors.New("Method not found")))
+
+	rpcErr, ok := AsRPCError(err)
+	assert.True(t, ok)
+	assert.Equal(t, CodeMethodNotFound, rpcErr.Code)
+}
+
+func TestRPCErrorData(t *testing.T) {
+	// string data is sent as a JSON string, as before
+	b, err := json.Marshal(RPCInvalidParamsError(StringID("1"), errors.New("bad")))
+	assert.NoError(t, err)
+	assert.Equal(t, `{"jsonrpc":"2.0","id":"1","error":{"code":-32602,"message":"Invalid params","data":"bad"}}`, string(b))
+
+	fields := []FieldError{{Field: "name", Message: "is required"}}
+	b, err = json.Marshal(RPCInvalidFieldsError(StringID("1"), fields))
+	assert.NoError(t, err)
+	var resp RPCResponse
+	assert.NoError(t, json.Unmarshal(b, &resp))
+	var decoded []FieldError
+	assert.NoError(t, resp.Error.DecodeData(&decoded))
+	assert.Equal(t, fields, decoded)
+	assert.Error(t, (&RPCError{}).DecodeData(&decoded))
+
+	cdc := amino.NewCodec()
+	data, err := EncodeErrorData(cdc, SampleResult{"hello"})
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{"Value":"hello"}`, string(data))
+	data, err = EncodeErrorData(cdc, nil)
+	assert.NoError(t, err)
+	assert.Nil(t, data)
+}